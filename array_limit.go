@@ -0,0 +1,126 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+// limitArrays orders and limits every occurrence of the array of a LIMIT directive alias
+// (e.g. the comments of each post), so the limit applies per parent
+func (db *DB) limitArrays(result interface{}, hint LimitHint, columnMapping []string, paths []string) (interface{}, error) {
+	arrayPath := ""
+	for i, mapping := range columnMapping {
+		if strings.HasPrefix(mapping, hint.Alias+".") && i < len(paths) {
+			arrayPath = paths[i][:strings.LastIndex(paths[i], ".")]
+			break
+		}
+	}
+	if arrayPath == "" {
+		return nil, fmt.Errorf("LIMIT %s requires a column of %s in the result", hint.Alias, hint.Alias)
+	}
+	if !strings.HasSuffix(arrayPath, "[]") {
+		return nil, fmt.Errorf("LIMIT %s requires the rows at %s to be an array", hint.Alias, arrayPath)
+	}
+
+	// Find the keys of the ORDER BY columns in the elements of the array
+	keys := []string{}
+	for _, order := range hint.OrderBy {
+		key := ""
+		for i, mapping := range columnMapping {
+			if mapping == order.Alias+"."+order.Column && i < len(paths) && paths[i] == arrayPath+"."+order.Column {
+				key = order.Column
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("LIMIT %s requires the column %s.%s in the rows at %s", hint.Alias, order.Alias, order.Column, arrayPath)
+		}
+		keys = append(keys, key)
+	}
+
+	// Apply to the array itself, not to its elements
+	steps := pathSteps(arrayPath)
+	return applyAtPath(result, steps[:len(steps)-1], func(value interface{}) (interface{}, error) {
+		elements, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+		sort.SliceStable(elements, func(i, j int) bool {
+			a, _ := elements[i].(*orderedmap.OrderedMap)
+			b, _ := elements[j].(*orderedmap.OrderedMap)
+			if a == nil || b == nil {
+				return false
+			}
+			for k, key := range keys {
+				x, _ := a.Get(key)
+				y, _ := b.Get(key)
+				c := compareValues(x, y)
+				if hint.OrderBy[k].Desc {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+		if len(elements) > hint.Limit {
+			elements = elements[:hint.Limit]
+		}
+		return elements, nil
+	})
+}
+
+// compareValues compares two scanned values, NULL sorts before any other value
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// toFloat converts a numeric value to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,424 @@
+package pathsqlx
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// DerivedTable is a CTE or a subquery in FROM whose rows and columns are traced back to
+// the table it selects from, so that joins on it follow the foreign keys of that table
+type DerivedTable struct {
+	Name      string
+	Columns   []string          // output columns, nil when they are all columns of the table
+	Table     string            // table (or CTE) the rows are selected from, "" if unknown
+	Lineage   map[string]string // output column -> column of the table
+	Recursive bool
+}
+
+// extractCTEs registers the CTEs of a WITH clause as derived tables and returns the
+// query that follows them, the parser doesn't support WITH
+// Format: WITH [RECURSIVE] name [(column, ...)] AS (query) [, ...] SELECT ...
+func extractCTEs(sql string, analysis *QueryAnalysis) string {
+	rest := skipSpaceAndComments(sql)
+	with := regexp.MustCompile(`(?i)^WITH\s+(RECURSIVE\s+)?`).FindStringSubmatch(rest)
+	if with == nil {
+		return sql
+	}
+	recursive := with[1] != ""
+	rest = rest[len(with[0]):]
+	head := regexp.MustCompile("(?is)^(" + identifierPattern + ")\\s*(?:\\(([^)]*)\\)\\s*)?AS\\s+(?:(?:NOT\\s+)?MATERIALIZED\\s+)?\\(")
+	for {
+		match := head.FindStringSubmatch(rest)
+		if match == nil {
+			return sql
+		}
+		end := matchParenthesis(rest, len(match[0])-1)
+		if end < 0 {
+			return sql
+		}
+		name := analysis.Dialect.identifier(match[1])
+		var columns []string
+		if match[2] != "" {
+			for _, column := range strings.Split(match[2], ",") {
+				columns = append(columns, analysis.Dialect.identifier(strings.TrimSpace(column)))
+			}
+		}
+		analysis.Derived[name] = derivedTableFromQuery(name, columns, rest[len(match[0]):end], recursive)
+		rest = skipSpaceAndComments(rest[end+1:])
+		if !strings.HasPrefix(rest, ",") {
+			return rest
+		}
+		rest = skipSpaceAndComments(rest[1:])
+	}
+}
+
+// derivedTableFromQuery traces the columns of a CTE
+func derivedTableFromQuery(name string, columns []string, query string, recursive bool) *DerivedTable {
+	derived := &DerivedTable{Name: name}
+	if stmt, err := sqlparser.Parse(query); err == nil {
+		if sel, ok := stmt.(sqlparser.SelectStatement); ok {
+			derived = derivedTableFromStatement(name, sel)
+		}
+	}
+	derived.Recursive = recursive
+	if columns == nil {
+		return derived
+	}
+
+	// The column list renames the output columns by position
+	if derived.Columns == nil && derived.Table != "" {
+		// The columns of the table are unknown here
+		return &DerivedTable{Name: name, Columns: columns, Recursive: recursive}
+	}
+	lineage := map[string]string{}
+	for i, column := range columns {
+		if i < len(derived.Columns) {
+			if source, ok := derived.Lineage[derived.Columns[i]]; ok {
+				lineage[column] = source
+			}
+		}
+	}
+	derived.Columns = columns
+	derived.Lineage = lineage
+	return derived
+}
+
+// derivedTableFromStatement traces the columns of a CTE or subquery, the anchor (first
+// branch) of a UNION is used, as that is the part of a recursive CTE that selects from a table
+func derivedTableFromStatement(name string, stmt sqlparser.SelectStatement) *DerivedTable {
+	for {
+		switch s := stmt.(type) {
+		case *sqlparser.Union:
+			stmt = s.Left
+		case *sqlparser.ParenSelect:
+			stmt = s.Select
+		case *sqlparser.Select:
+			return derivedTableFromSelect(name, s)
+		default:
+			return &DerivedTable{Name: name}
+		}
+	}
+}
+
+// derivedTableFromSelect traces the output columns of a SELECT to the first table of its
+// FROM clause, columns of other tables and expressions have no lineage
+func derivedTableFromSelect(name string, sel *sqlparser.Select) *DerivedTable {
+	derived := &DerivedTable{Name: name, Columns: []string{}, Lineage: map[string]string{}}
+	from := &QueryAnalysis{Tables: make(map[string]string), Derived: make(map[string]*DerivedTable)}
+	for _, tableExpr := range sel.From {
+		extractTablesFromExpr(tableExpr, from)
+	}
+	aliases := from.OrderedAliases()
+	if len(aliases) == 0 {
+		return derived
+	}
+	alias := aliases[0]
+	table := from.Tables[alias]
+
+	for _, selectExpr := range sel.SelectExprs {
+		switch expr := selectExpr.(type) {
+		case *sqlparser.StarExpr:
+			qualifier := expr.TableName.Name.String()
+			if len(sel.SelectExprs) == 1 && (qualifier == alias || (qualifier == "" && len(aliases) == 1)) {
+				// All columns of the table
+				return (&DerivedTable{Name: name, Table: table}).selectFrom(from.Derived[table])
+			}
+			return &DerivedTable{Name: name}
+		case *sqlparser.AliasedExpr:
+			column := selectColumn(expr)
+			if column.Name == "" {
+				column.Name = column.Expr
+			}
+			derived.Columns = append(derived.Columns, column.Name)
+			if column.Column != "" && (column.Alias == alias || (column.Alias == "" && len(aliases) == 1)) {
+				derived.Lineage[column.Name] = column.Column
+			}
+		}
+	}
+	if len(derived.Lineage) > 0 {
+		derived.Table = table
+	}
+	return derived.selectFrom(from.Derived[table])
+}
+
+// selectFrom traces the lineage of a derived table through the subquery it selects from
+func (d *DerivedTable) selectFrom(subquery *DerivedTable) *DerivedTable {
+	if subquery == nil || d.Table == "" {
+		return d
+	}
+	d.Table = subquery.Table
+	if d.Columns == nil {
+		d.Columns = subquery.Columns
+		d.Lineage = subquery.Lineage
+		return d
+	}
+	if subquery.Columns == nil {
+		return d
+	}
+	lineage := map[string]string{}
+	for column, source := range d.Lineage {
+		if base, ok := subquery.Lineage[source]; ok {
+			lineage[column] = base
+		}
+	}
+	d.Lineage = lineage
+	return d
+}
+
+// skipSpaceAndComments removes leading white space and comments
+func skipSpaceAndComments(sql string) string {
+	for {
+		sql = strings.TrimLeft(sql, " \t\r\n")
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			end := strings.Index(sql, "\n")
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+1:]
+		case strings.HasPrefix(sql, "/*"):
+			end := strings.Index(sql, "*/")
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+2:]
+		default:
+			return sql
+		}
+	}
+}
+
+// matchParenthesis returns the position of the parenthesis that closes the one at open,
+// skipping quoted strings, identifiers and comments, or -1 if it isn't closed
+func matchParenthesis(sql string, open int) int {
+	depth := 0
+	for i := open; i < len(sql); i++ {
+		switch ch := sql[i]; {
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			for i++; i < len(sql) && sql[i] != ch; i++ {
+				if sql[i] == '\\' {
+					i++
+				}
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		}
+	}
+	return -1
+}
+
+// derivedMetadataReader adds the derived tables of a query to the metadata of a reader
+// A derived table has the columns, primary key and foreign keys of its table, renamed
+// after its output columns, as far as they are selected.
+type derivedMetadataReader struct {
+	MetadataReader
+	derived map[string]*DerivedTable
+}
+
+// metadataReader returns a reader that also knows the derived tables of the query
+func (a *QueryAnalysis) metadataReader(metadata MetadataReader) MetadataReader {
+	if metadata == nil || len(a.Derived) == 0 {
+		return metadata
+	}
+	if _, ok := metadata.(*derivedMetadataReader); ok {
+		return metadata
+	}
+	return &derivedMetadataReader{MetadataReader: metadata, derived: a.Derived}
+}
+
+// resolve returns the base table of a table and the lineage of its columns to that
+// table, a nil lineage means the columns are those of the base table
+func (r *derivedMetadataReader) resolve(name string, depth int) (string, map[string]string) {
+	derived, ok := r.derived[name]
+	if !ok {
+		return name, nil
+	}
+	if derived.Table == "" || depth > len(r.derived) {
+		return "", map[string]string{}
+	}
+	table, inner := r.resolve(derived.Table, depth+1)
+	if derived.Columns == nil {
+		return table, inner
+	}
+	lineage := map[string]string{}
+	for column, source := range derived.Lineage {
+		if inner == nil {
+			lineage[column] = source
+		} else if base, ok := inner[source]; ok {
+			lineage[column] = base
+		}
+	}
+	return table, lineage
+}
+
+// columns returns the output columns of a table
+func (r *derivedMetadataReader) columns(name string, depth int) []string {
+	derived, ok := r.derived[name]
+	if !ok {
+		metadata, err := r.MetadataReader.GetTableMetadata(name)
+		if err != nil {
+			return nil
+		}
+		return metadata.Columns
+	}
+	if derived.Columns == nil && derived.Table != "" && depth <= len(r.derived) {
+		return r.columns(derived.Table, depth+1)
+	}
+	return derived.Columns
+}
+
+// outputColumns maps base table columns to the output columns of a derived table
+func (r *derivedMetadataReader) outputColumns(name string, lineage map[string]string, columns []string) ([]string, bool) {
+	if lineage == nil {
+		return columns, true
+	}
+	outputs := r.columns(name, 0)
+	result := []string{}
+	for _, column := range columns {
+		found := false
+		for _, output := range outputs {
+			if lineage[output] == column {
+				result = append(result, output)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// GetTableMetadata returns the metadata of a table or derived table
+func (r *derivedMetadataReader) GetTableMetadata(tableName string) (*TableMetadata, error) {
+	if _, ok := r.derived[tableName]; !ok {
+		return r.MetadataReader.GetTableMetadata(tableName)
+	}
+	metadata := &TableMetadata{Name: tableName, Columns: r.columns(tableName, 0)}
+	table, lineage := r.resolve(tableName, 0)
+	if table == "" {
+		return metadata, nil
+	}
+	base, err := r.MetadataReader.GetTableMetadata(table)
+	if err != nil {
+		return metadata, nil
+	}
+	if primaryKeys, ok := r.outputColumns(tableName, lineage, base.PrimaryKeys); ok {
+		metadata.PrimaryKeys = primaryKeys
+	}
+	fks, err := r.GetForeignKeys(tableName)
+	if err != nil {
+		return nil, err
+	}
+	metadata.ForeignKeys = fks
+	return metadata, nil
+}
+
+// GetForeignKeys returns the foreign keys of a table or derived table
+func (r *derivedMetadataReader) GetForeignKeys(tableName string) ([]ForeignKey, error) {
+	allFKs, err := r.GetAllForeignKeys()
+	if err != nil {
+		return nil, err
+	}
+	fks := []ForeignKey{}
+	for _, fk := range allFKs {
+		if isTable(r.MetadataReader, tableName, fk.FromSchema, fk.FromTable) {
+			fks = append(fks, fk)
+		}
+	}
+	return fks, nil
+}
+
+// GetAllForeignKeys returns the foreign keys of the database and a copy of each foreign
+// key for every derived table that selects its columns, on either side
+func (r *derivedMetadataReader) GetAllForeignKeys() ([]ForeignKey, error) {
+	allFKs, err := r.MetadataReader.GetAllForeignKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range r.derived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fks := append([]ForeignKey{}, allFKs...)
+	for _, fk := range allFKs {
+		from := []string{qualifiedTableName(fk.FromSchema, fk.FromTable)}
+		to := []string{qualifiedTableName(fk.ToSchema, fk.ToTable)}
+		for _, name := range names {
+			table, _ := r.resolve(name, 0)
+			if table == "" {
+				continue
+			}
+			if isTable(r.MetadataReader, table, fk.FromSchema, fk.FromTable) {
+				from = append(from, name)
+			}
+			if isTable(r.MetadataReader, table, fk.ToSchema, fk.ToTable) {
+				to = append(to, name)
+			}
+		}
+		for i, fromTable := range from {
+			for j, toTable := range to {
+				if i == 0 && j == 0 {
+					continue
+				}
+				if copied, ok := r.renameForeignKey(fk, fromTable, toTable); ok {
+					fks = append(fks, copied)
+				}
+			}
+		}
+	}
+	return fks, nil
+}
+
+// renameForeignKey copies a foreign key to (derived) tables with the same base tables, a
+// side that is a table keeps its schema
+func (r *derivedMetadataReader) renameForeignKey(fk ForeignKey, fromTable, toTable string) (ForeignKey, bool) {
+	fromColumns := []string{}
+	toColumns := []string{}
+	for _, pair := range fk.Columns {
+		fromColumns = append(fromColumns, pair.From)
+		toColumns = append(toColumns, pair.To)
+	}
+	_, fromLineage := r.resolve(fromTable, 0)
+	fromColumns, ok := r.outputColumns(fromTable, fromLineage, fromColumns)
+	if !ok {
+		return fk, false
+	}
+	_, toLineage := r.resolve(toTable, 0)
+	toColumns, ok = r.outputColumns(toTable, toLineage, toColumns)
+	if !ok {
+		return fk, false
+	}
+	copied := ForeignKey{Name: fk.Name, FromSchema: fk.FromSchema, FromTable: fk.FromTable, ToSchema: fk.ToSchema, ToTable: fk.ToTable}
+	if _, ok := r.derived[fromTable]; ok {
+		copied.FromSchema, copied.FromTable = "", fromTable
+	}
+	if _, ok := r.derived[toTable]; ok {
+		copied.ToSchema, copied.ToTable = "", toTable
+	}
+	for i := range fromColumns {
+		copied.Columns = append(copied.Columns, ColumnPair{From: fromColumns[i], To: toColumns[i]})
+	}
+	return copied, true
+}
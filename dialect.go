@@ -0,0 +1,185 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL dialect of a query, the parser only supports MySQL syntax
+type Dialect string
+
+// Supported dialects, named after their database driver
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// DialectOf returns the dialect of a database driver, MySQL is the default
+func DialectOf(driverName string) Dialect {
+	switch driverName {
+	case "postgres", "pgx":
+		return Postgres
+	}
+	return MySQL
+}
+
+// dialect returns the dialect of the database driver
+func (db *DB) dialect() Dialect {
+	return DialectOf(db.DriverName())
+}
+
+var (
+	rePostgresCast      = regexp.MustCompile(`(?i)::\s*[\w.]+(?:\s+(?:varying|precision|with(?:out)?\s+time\s+zone))?(?:\s*\(\s*\d+(?:\s*,\s*\d+)?\s*\))?(?:\s*\[\s*\])*`)
+	rePostgresParameter = regexp.MustCompile(`\$(\d+)\b`)
+	rePostgresILike     = regexp.MustCompile(`(?i)\bILIKE\b`)
+	rePostgresDistinct  = regexp.MustCompile(`(?i)\bDISTINCT\s+ON\s*\(`)
+	rePostgresLateral   = regexp.MustCompile(`(?i)\bLATERAL\s+`)
+	rePostgresInsert    = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+([\w.\x00` + "`" + `]+)(?:\s+AS\s+(\w+))?.*?\sRETURNING\s+(.+)$`)
+	rePostgresUpdate    = regexp.MustCompile(`(?is)^\s*UPDATE\s+(?:ONLY\s+)?([\w.\x00` + "`" + `]+)(?:\s+(?:AS\s+)?(\w+))?\s+SET\s.*?\sRETURNING\s+(.+)$`)
+	rePostgresDelete    = regexp.MustCompile(`(?is)^\s*DELETE\s+FROM\s+(?:ONLY\s+)?([\w.\x00` + "`" + `]+)(?:\s+(?:AS\s+)?(\w+))?(?:\s.*?)?\sRETURNING\s+(.+)$`)
+	rePostgresEscape    = regexp.MustCompile("(?i)\\bE(\x00\\d+\x00)")
+	reMaskedLiteral     = regexp.MustCompile("\x00(\\d+)\x00")
+	reDollarQuote       = regexp.MustCompile(`^\$(?:[A-Za-z_]\w*)?\$`)
+)
+
+// normalize rewrites the syntax of a dialect that the parser doesn't support into MySQL
+// syntax with the same structure. The result is only used for the analysis, the query
+// itself is executed as written.
+func (d Dialect) normalize(sql string) string {
+	if d != Postgres {
+		return sql
+	}
+	masked, literals := maskLiterals(sql, d)
+
+	// Casts don't change where a column comes from: p.id::text is p.id
+	masked = rePostgresCast.ReplaceAllString(masked, "")
+	// Positional parameters become named parameters: $1 is :v1
+	masked = rePostgresParameter.ReplaceAllString(masked, ":v$1")
+	// Escape strings are strings: E'a\tb' is 'a\tb', in other strings a backslash is a
+	// backslash: 'a\' is 'a\\'
+	escaped := map[string]bool{}
+	for _, match := range rePostgresEscape.FindAllStringSubmatch(masked, -1) {
+		escaped[match[1]] = true
+	}
+	masked = rePostgresEscape.ReplaceAllString(masked, "$1")
+	masked = rePostgresILike.ReplaceAllString(masked, "LIKE")
+	masked = rePostgresLateral.ReplaceAllString(masked, "")
+	// DISTINCT ON (...) selects the same columns as DISTINCT
+	for {
+		loc := rePostgresDistinct.FindStringIndex(masked)
+		if loc == nil {
+			break
+		}
+		end := matchParenthesis(masked, loc[1]-1)
+		if end < 0 {
+			break
+		}
+		masked = masked[:loc[0]] + "DISTINCT" + masked[end+1:]
+	}
+	// The RETURNING clause of a data-modifying statement selects from its table
+	for _, re := range []*regexp.Regexp{rePostgresInsert, rePostgresUpdate, rePostgresDelete} {
+		if match := re.FindStringSubmatch(masked); match != nil {
+			table := match[1]
+			switch strings.ToUpper(match[2]) {
+			case "", "WHERE", "USING", "RETURNING", "DEFAULT", "VALUES", "SELECT":
+			default:
+				table += " " + match[2]
+			}
+			// A comment at the end of the columns ends at the line break
+			masked = fmt.Sprintf("SELECT %s\nFROM %s", strings.TrimSpace(match[3]), table)
+			break
+		}
+	}
+
+	// Unquoted names are folded to lower case like PostgreSQL does: Posts is posts (and
+	// "Posts" is `Posts`), so the analysis has the names of the catalog
+	masked = strings.ToLower(masked)
+
+	return reMaskedLiteral.ReplaceAllStringFunc(masked, func(placeholder string) string {
+		i, _ := strconv.Atoi(strings.Trim(placeholder, "\x00"))
+		// Quoted identifiers are quoted with backticks: "Order Items" is `Order Items`
+		if strings.HasPrefix(literals[i], `"`) {
+			return quoteIdentifier(unquoteIdentifier(literals[i]))
+		}
+		if strings.HasPrefix(literals[i], "'") && !escaped[placeholder] {
+			return strings.Replace(literals[i], `\`, `\\`, -1)
+		}
+		return literals[i]
+	})
+}
+
+// quoteIdentifier quotes an identifier with backticks
+func quoteIdentifier(identifier string) string {
+	return "`" + strings.Replace(identifier, "`", "``", -1) + "`"
+}
+
+// maskLiterals replaces string literals, quoted identifiers and comments by placeholders,
+// so that they are not rewritten. In MySQL # starts a comment (in PostgreSQL it is an
+// operator) and a backslash escapes a character in a string, in PostgreSQL only in an
+// escape string (E'...').
+func maskLiterals(sql string, dialect Dialect) (string, []string) {
+	var masked strings.Builder
+	literals := []string{}
+	mask := func(literal string) {
+		masked.WriteString("\x00" + strconv.Itoa(len(literals)) + "\x00")
+		literals = append(literals, literal)
+	}
+	for i := 0; i < len(sql); i++ {
+		start := i
+		switch ch := sql[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			escapes := ch != '`' && dialect != Postgres
+			if ch == '\'' && dialect == Postgres && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isWordChar(sql[i-2])) {
+				escapes = true
+			}
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' && escapes {
+					i++
+					continue
+				}
+				if sql[i] == ch {
+					// A doubled quote is an escaped quote
+					if i+1 < len(sql) && sql[i+1] == ch {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			if i >= len(sql) {
+				i = len(sql) - 1
+			}
+			mask(sql[start : i+1])
+		case ch == '$' && reDollarQuote.MatchString(sql[i:]):
+			tag := reDollarQuote.FindString(sql[i:])
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				i = len(sql) - 1
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+			mask(sql[start : i+1])
+		case strings.HasPrefix(sql[i:], "--") || (ch == '#' && dialect != Postgres):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			mask(sql[start:i])
+			if i < len(sql) {
+				masked.WriteByte('\n')
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql) - 1
+			} else {
+				i += end + 3
+			}
+			mask(sql[start : i+1])
+		default:
+			masked.WriteByte(ch)
+		}
+	}
+	return masked.String(), literals
+}
@@ -0,0 +1,78 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LimitError is returned when a path query exceeds one of the limits set on the DB
+type LimitError struct {
+	Limit string // name of the DB field, e.g. "MaxRows"
+	Max   int
+	Path  string // path that exceeds MaxDepth or MaxSiblingArrays
+}
+
+// Error implements the error interface
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case "MaxDepth":
+		return fmt.Sprintf("path %s is nested deeper than MaxDepth (%d)", e.Path, e.Max)
+	case "MaxSiblingArrays":
+		return fmt.Sprintf("more than %d one-to-many joins under %s multiply the rows, use SplitQueries or separate queries", e.Max, e.Path)
+	}
+	return fmt.Sprintf("query result exceeds %s (%d)", e.Limit, e.Max)
+}
+
+// checkPathLimits checks the paths of a query against MaxDepth and MaxSiblingArrays
+// before any row is read
+func (db *DB) checkPathLimits(paths []string) error {
+	arrays := map[string]map[string]bool{}
+	for _, path := range paths {
+		steps := pathSteps(path)
+		if db.MaxDepth > 0 && len(steps)-1 > db.MaxDepth {
+			return &LimitError{Limit: "MaxDepth", Max: db.MaxDepth, Path: path}
+		}
+		// Collect the arrays by the object they are in
+		for i := strings.Index(path, "[]"); i >= 0; {
+			array := path[:i]
+			if dot := strings.LastIndex(array, "."); dot >= 0 {
+				if arrays[array[:dot]] == nil {
+					arrays[array[:dot]] = map[string]bool{}
+				}
+				arrays[array[:dot]][array[dot+1:]] = true
+			}
+			next := strings.Index(path[i+2:], "[]")
+			if next < 0 {
+				break
+			}
+			i += 2 + next
+		}
+	}
+	if db.MaxSiblingArrays > 0 {
+		containers := []string{}
+		for container := range arrays {
+			containers = append(containers, container)
+		}
+		sort.Strings(containers)
+		for _, container := range containers {
+			if len(arrays[container]) > db.MaxSiblingArrays {
+				return &LimitError{Limit: "MaxSiblingArrays", Max: db.MaxSiblingArrays, Path: container}
+			}
+		}
+	}
+	return nil
+}
+
+// valueSize estimates the number of bytes a scanned value takes in the result
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	}
+	return 8
+}
@@ -1,21 +1,42 @@
 package pathsqlx
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"sync"
 )
 
-// ForeignKey represents a foreign key relationship
+// ForeignKey represents a foreign key relationship (constraint) with one or more columns,
+// the schemas are empty when the tables are in the default schema or the names are
+// schema-qualified
 type ForeignKey struct {
+	Name       string
+	FromSchema string
 	FromTable  string
-	FromColumn string
+	ToSchema   string
 	ToTable    string
-	ToColumn   string
+	Columns    []ColumnPair
+}
+
+// ColumnPair is a column of a foreign key and the column it references
+type ColumnPair struct {
+	From string
+	To   string
+}
+
+// PolymorphicRelation represents a polymorphic association: a type (discriminator) column
+// and an id column that together reference a row in one of several tables, without a FK
+type PolymorphicRelation struct {
+	Table      string
+	TypeColumn string
+	IDColumn   string
 }
 
 // TableMetadata represents metadata for a database table
 type TableMetadata struct {
+	Schema      string
 	Name        string
 	Columns     []string
 	PrimaryKeys []string
@@ -34,9 +55,16 @@ type MetadataReader interface {
 type metadataReaderImpl struct {
 	db         *sql.DB
 	driverName string
-	cache      map[string]*TableMetadata
-	fkCache    []ForeignKey
-	mu         sync.RWMutex
+	schemas    []string // search_path of the connection of a path query, nil when not read
+	*metadataCache
+}
+
+// metadataCache is the metadata that the readers of the connections of a database share
+type metadataCache struct {
+	cache   map[string]*TableMetadata
+	fkCache []ForeignKey
+	names   map[string]string
+	mu      sync.RWMutex
 }
 
 // NewMetadataReader creates a new MetadataReader
@@ -44,23 +72,236 @@ func NewMetadataReader(db *sql.DB, driverName string) MetadataReader {
 	return &metadataReaderImpl{
 		db:         db,
 		driverName: driverName,
-		cache:      make(map[string]*TableMetadata),
+		metadataCache: &metadataCache{
+			cache: make(map[string]*TableMetadata),
+			names: make(map[string]string),
+		},
+	}
+}
+
+// forConnection returns a reader that resolves unqualified table names with the search_path
+// (PostgreSQL) of a connection, it is read once and the reader shares the cache
+func (r *metadataReaderImpl) forConnection(ctx context.Context, conn *sql.Conn) (*metadataReaderImpl, error) {
+	if DialectOf(r.driverName) != Postgres {
+		return r, nil
+	}
+	rows, err := conn.QueryContext(ctx, searchPathQuery)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := scanSchemas(rows)
+	if err != nil {
+		return nil, err
 	}
+	return &metadataReaderImpl{db: r.db, driverName: r.driverName, schemas: schemas, metadataCache: r.metadataCache}, nil
 }
 
-// InvalidateCache clears the metadata cache
+// InvalidateCache clears the metadata cache, also the tables that the names in queries
+// were resolved to (after a change of the schema)
 func (r *metadataReaderImpl) InvalidateCache() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.cache = make(map[string]*TableMetadata)
 	r.fkCache = nil
+	r.names = make(map[string]string)
+}
+
+// splitTableName splits a schema-qualified table name, the schema is empty when the name
+// is not qualified
+func splitTableName(name string) (string, string) {
+	if i := strings.Index(name, "."); i > 0 && !strings.HasPrefix(name, "(") {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// qualifiedTableName returns the table name with its schema, when it has one
+func qualifiedTableName(schema, table string) string {
+	if schema == "" {
+		return table
+	}
+	return schema + "." + table
+}
+
+// isTable checks whether a table name of a query is the table of a foreign key, a name in
+// another case or without a schema is the table that the metadata finds (that matches the
+// name like the database does), the names of the catalog are compared exactly
+func isTable(metadata MetadataReader, name, schema, table string) bool {
+	if schema == "" {
+		schema, table = splitTableName(table)
+	}
+	nameSchema, nameTable := splitTableName(name)
+	if !strings.EqualFold(nameTable, table) {
+		return false
+	}
+	if (nameTable != table || (nameSchema == "" && schema != "")) && metadata != nil {
+		if tableMetadata, err := metadata.GetTableMetadata(name); err == nil {
+			nameSchema, nameTable = tableMetadata.Schema, tableMetadata.Name
+		}
+	}
+	return nameTable == table && (nameSchema == "" || schema == "" || nameSchema == schema)
+}
+
+// resolveTableName returns the schema and the name of a (schema-qualified) table name as
+// they are in the catalog, an unqualified name is in the current database (MySQL) or the
+// first schema of the search_path that has the table (PostgreSQL). Names are matched like
+// the database does: following lower_case_table_names (MySQL) or exactly (PostgreSQL, the
+// analysis has folded the unquoted names of the query to lower case).
+func (r *metadataReaderImpl) resolveTableName(tableName string) (string, string, error) {
+	key := tableName
+	schemas, err := r.searchPath(tableName)
+	if err != nil {
+		return "", "", err
+	}
+	if schemas != nil {
+		quoted := make([]string, len(schemas))
+		for i, schema := range schemas {
+			quoted[i] = quotePostgresName("", schema)
+		}
+		key = strings.Join(quoted, ",") + ":" + tableName
+	}
+	r.mu.RLock()
+	name, ok := r.names[key]
+	r.mu.RUnlock()
+	if ok {
+		schema, table := splitTableName(name)
+		return schema, table, nil
+	}
+
+	schema, table := splitTableName(tableName)
+	if schemas != nil {
+		schema, err = r.schemaOf(table, schemas)
+		if err != nil {
+			return "", "", err
+		}
+		r.mu.Lock()
+		r.names[key] = qualifiedTableName(schema, table)
+		r.mu.Unlock()
+		return schema, table, nil
+	}
+
+	var query string
+	var args []interface{}
+	switch r.driverName {
+	case "mysql":
+		query = `
+			SELECT COALESCE(t.TABLE_SCHEMA, NULLIF(?, ''), DATABASE()), COALESCE(t.TABLE_NAME, ?)
+			FROM (SELECT 1) AS x
+			LEFT JOIN information_schema.TABLES AS t
+				ON t.TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND t.TABLE_NAME = ?
+		`
+		args = []interface{}{schema, table, schema, table}
+	case "postgres", "pgx":
+		// to_regclass looks the qualified table up like a query does
+		query = `
+			SELECT COALESCE(n.nspname, NULLIF($1, ''), current_schema()), COALESCE(c.relname, $2)
+			FROM (SELECT 1) AS x
+			LEFT JOIN pg_class c ON c.oid = to_regclass($3)
+			LEFT JOIN pg_namespace n ON n.oid = c.relnamespace
+		`
+		args = []interface{}{schema, table, quotePostgresName(schema, table)}
+	default:
+		return "", "", fmt.Errorf("unsupported driver: %s", r.driverName)
+	}
+
+	var resolvedSchema sql.NullString
+	if err := r.db.QueryRow(query, args...).Scan(&resolvedSchema, &table); err != nil {
+		return "", "", err
+	}
+
+	r.mu.Lock()
+	r.names[key] = qualifiedTableName(resolvedSchema.String, table)
+	r.mu.Unlock()
+	return resolvedSchema.String, table, nil
+}
+
+// searchPathQuery returns the schemas of the search_path (that exist) in order
+const searchPathQuery = `SELECT s FROM unnest(current_schemas(false)) WITH ORDINALITY AS t(s, i) ORDER BY i`
+
+// searchPath returns the schemas of the search_path (PostgreSQL) that an unqualified table
+// name is resolved with, the names are cached per search_path so that switching it (e.g.
+// per tenant) resolves them again. It is the search_path of the connection of the path
+// query, or of a connection of the pool when the reader is used directly. It is nil for
+// qualified names and on MySQL.
+func (r *metadataReaderImpl) searchPath(tableName string) ([]string, error) {
+	if schema, _ := splitTableName(tableName); schema != "" || DialectOf(r.driverName) != Postgres {
+		return nil, nil
+	}
+	if r.schemas != nil {
+		return r.schemas, nil
+	}
+	rows, err := r.db.Query(searchPathQuery)
+	if err != nil {
+		return nil, err
+	}
+	return scanSchemas(rows)
+}
+
+// scanSchemas reads the schemas of the search_path
+func scanSchemas(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	schemas := []string{}
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, rows.Err()
 }
 
-// GetTableMetadata retrieves metadata for a specific table
+// schemaOf returns the first schema of the search_path that has the table, a table that
+// doesn't exist is in the first schema (like a query looks it up)
+func (r *metadataReaderImpl) schemaOf(table string, schemas []string) (string, error) {
+	rows, err := r.db.Query(`
+		SELECT n.nspname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = $1
+	`, table)
+	if err != nil {
+		return "", err
+	}
+	found, err := scanSchemas(rows)
+	if err != nil {
+		return "", err
+	}
+	for _, schema := range schemas {
+		for _, other := range found {
+			if schema == other {
+				return schema, nil
+			}
+		}
+	}
+	if len(schemas) == 0 {
+		return "", nil
+	}
+	return schemas[0], nil
+}
+
+// quotePostgresName quotes the parts of a (schema-qualified) table name for PostgreSQL
+func quotePostgresName(schema, table string) string {
+	quote := func(identifier string) string {
+		return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+	}
+	if schema == "" {
+		return quote(table)
+	}
+	return quote(schema) + "." + quote(table)
+}
+
+// GetTableMetadata retrieves metadata for a specific table, cached per schema
 func (r *metadataReaderImpl) GetTableMetadata(tableName string) (*TableMetadata, error) {
+	schema, table, err := r.resolveTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
+	key := qualifiedTableName(schema, table)
+
 	// Check cache first
 	r.mu.RLock()
-	if cached, ok := r.cache[tableName]; ok {
+	if cached, ok := r.cache[key]; ok {
 		r.mu.RUnlock()
 		return cached, nil
 	}
@@ -68,18 +309,19 @@ func (r *metadataReaderImpl) GetTableMetadata(tableName string) (*TableMetadata,
 
 	// Fetch from database
 	metadata := &TableMetadata{
-		Name: tableName,
+		Schema: schema,
+		Name:   table,
 	}
 
 	// Get columns
-	columns, err := r.getColumns(tableName)
+	columns, err := r.getColumns(schema, table)
 	if err != nil {
 		return nil, err
 	}
 	metadata.Columns = columns
 
 	// Get primary keys
-	pks, err := r.getPrimaryKeys(tableName)
+	pks, err := r.getPrimaryKeys(schema, table)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +336,7 @@ func (r *metadataReaderImpl) GetTableMetadata(tableName string) (*TableMetadata,
 
 	// Cache the result
 	r.mu.Lock()
-	r.cache[tableName] = metadata
+	r.cache[key] = metadata
 	r.mu.Unlock()
 
 	return metadata, nil
@@ -106,10 +348,14 @@ func (r *metadataReaderImpl) GetForeignKeys(tableName string) ([]ForeignKey, err
 	if err != nil {
 		return nil, err
 	}
+	schema, table, err := r.resolveTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
 
 	result := []ForeignKey{}
 	for _, fk := range allFKs {
-		if fk.FromTable == tableName {
+		if fk.FromSchema == schema && fk.FromTable == table {
 			result = append(result, fk)
 		}
 	}
@@ -132,7 +378,7 @@ func (r *metadataReaderImpl) GetAllForeignKeys() ([]ForeignKey, error) {
 	switch r.driverName {
 	case "mysql":
 		fks, err = r.getMySQLForeignKeys()
-	case "postgres":
+	case "postgres", "pgx":
 		fks, err = r.getPostgresForeignKeys()
 	default:
 		return nil, fmt.Errorf("unsupported driver: %s", r.driverName)
@@ -150,17 +396,22 @@ func (r *metadataReaderImpl) GetAllForeignKeys() ([]ForeignKey, error) {
 	return fks, nil
 }
 
-// getMySQLForeignKeys retrieves foreign keys from MySQL/MariaDB
+// getMySQLForeignKeys retrieves foreign keys from MySQL/MariaDB, of all databases so
+// that joins across databases are found
 func (r *metadataReaderImpl) getMySQLForeignKeys() ([]ForeignKey, error) {
 	query := `
 		SELECT 
+			CONSTRAINT_NAME,
+			TABLE_SCHEMA,
 			TABLE_NAME,
 			COLUMN_NAME,
+			REFERENCED_TABLE_SCHEMA,
 			REFERENCED_TABLE_NAME,
 			REFERENCED_COLUMN_NAME
 		FROM information_schema.KEY_COLUMN_USAGE
 		WHERE REFERENCED_TABLE_NAME IS NOT NULL
-		AND TABLE_SCHEMA = DATABASE()
+		AND TABLE_SCHEMA NOT IN ('mysql', 'sys', 'information_schema', 'performance_schema')
+		ORDER BY TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION
 	`
 
 	rows, err := r.db.Query(query)
@@ -169,36 +420,32 @@ func (r *metadataReaderImpl) getMySQLForeignKeys() ([]ForeignKey, error) {
 	}
 	defer rows.Close()
 
-	var fks []ForeignKey
-	for rows.Next() {
-		var fk ForeignKey
-		err := rows.Scan(&fk.FromTable, &fk.FromColumn, &fk.ToTable, &fk.ToColumn)
-		if err != nil {
-			return nil, err
-		}
-		fks = append(fks, fk)
-	}
-
-	return fks, rows.Err()
+	return scanForeignKeys(rows)
 }
 
-// getPostgresForeignKeys retrieves foreign keys from PostgreSQL
+// getPostgresForeignKeys retrieves foreign keys from PostgreSQL, of all schemas
 func (r *metadataReaderImpl) getPostgresForeignKeys() ([]ForeignKey, error) {
+	// The referenced columns are matched by position, constraint_column_usage can't
+	// tell the columns of a composite foreign key apart
 	query := `
 		SELECT
-			tc.table_name,
+			kcu.constraint_name,
+			kcu.table_schema,
+			kcu.table_name,
 			kcu.column_name,
-			ccu.table_name AS foreign_table_name,
-			ccu.column_name AS foreign_column_name
-		FROM information_schema.table_constraints AS tc
+			ref.table_schema AS foreign_table_schema,
+			ref.table_name AS foreign_table_name,
+			ref.column_name AS foreign_column_name
+		FROM information_schema.referential_constraints AS rc
 		JOIN information_schema.key_column_usage AS kcu
-			ON tc.constraint_name = kcu.constraint_name
-			AND tc.table_schema = kcu.table_schema
-		JOIN information_schema.constraint_column_usage AS ccu
-			ON ccu.constraint_name = tc.constraint_name
-			AND ccu.table_schema = tc.table_schema
-		WHERE tc.constraint_type = 'FOREIGN KEY'
-			AND tc.table_schema = 'public'
+			ON kcu.constraint_name = rc.constraint_name
+			AND kcu.constraint_schema = rc.constraint_schema
+		JOIN information_schema.key_column_usage AS ref
+			ON ref.constraint_name = rc.unique_constraint_name
+			AND ref.constraint_schema = rc.unique_constraint_schema
+			AND ref.ordinal_position = kcu.position_in_unique_constraint
+		WHERE kcu.table_schema NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY kcu.table_schema, kcu.table_name, kcu.constraint_name, kcu.ordinal_position
 	`
 
 	rows, err := r.db.Query(query)
@@ -207,13 +454,27 @@ func (r *metadataReaderImpl) getPostgresForeignKeys() ([]ForeignKey, error) {
 	}
 	defer rows.Close()
 
+	return scanForeignKeys(rows)
+}
+
+// scanForeignKeys groups the rows of a foreign key query (constraint name, schema, table,
+// column, referenced schema, referenced table, referenced column) by constraint, in
+// column order
+func scanForeignKeys(rows *sql.Rows) ([]ForeignKey, error) {
 	var fks []ForeignKey
 	for rows.Next() {
 		var fk ForeignKey
-		err := rows.Scan(&fk.FromTable, &fk.FromColumn, &fk.ToTable, &fk.ToColumn)
+		var pair ColumnPair
+		err := rows.Scan(&fk.Name, &fk.FromSchema, &fk.FromTable, &pair.From, &fk.ToSchema, &fk.ToTable, &pair.To)
 		if err != nil {
 			return nil, err
 		}
+		last := len(fks) - 1
+		if last >= 0 && fks[last].Name == fk.Name && fks[last].FromSchema == fk.FromSchema && fks[last].FromTable == fk.FromTable {
+			fks[last].Columns = append(fks[last].Columns, pair)
+			continue
+		}
+		fk.Columns = []ColumnPair{pair}
 		fks = append(fks, fk)
 	}
 
@@ -221,28 +482,28 @@ func (r *metadataReaderImpl) getPostgresForeignKeys() ([]ForeignKey, error) {
 }
 
 // getColumns retrieves column names for a table
-func (r *metadataReaderImpl) getColumns(tableName string) ([]string, error) {
+func (r *metadataReaderImpl) getColumns(schema, tableName string) ([]string, error) {
 	var query string
 	switch r.driverName {
 	case "mysql":
 		query = `
 			SELECT COLUMN_NAME
 			FROM information_schema.COLUMNS
-			WHERE TABLE_NAME = ? AND TABLE_SCHEMA = DATABASE()
+			WHERE TABLE_NAME = ? AND TABLE_SCHEMA = ?
 			ORDER BY ORDINAL_POSITION
 		`
-	case "postgres":
+	case "postgres", "pgx":
 		query = `
 			SELECT column_name
 			FROM information_schema.columns
-			WHERE table_name = $1 AND table_schema = 'public'
+			WHERE table_name = $1 AND table_schema = $2
 			ORDER BY ordinal_position
 		`
 	default:
 		return nil, fmt.Errorf("unsupported driver: %s", r.driverName)
 	}
 
-	rows, err := r.db.Query(query, tableName)
+	rows, err := r.db.Query(query, tableName, schema)
 	if err != nil {
 		return nil, err
 	}
@@ -261,7 +522,7 @@ func (r *metadataReaderImpl) getColumns(tableName string) ([]string, error) {
 }
 
 // getPrimaryKeys retrieves primary key columns for a table
-func (r *metadataReaderImpl) getPrimaryKeys(tableName string) ([]string, error) {
+func (r *metadataReaderImpl) getPrimaryKeys(schema, tableName string) ([]string, error) {
 	var query string
 	switch r.driverName {
 	case "mysql":
@@ -270,10 +531,10 @@ func (r *metadataReaderImpl) getPrimaryKeys(tableName string) ([]string, error)
 			FROM information_schema.KEY_COLUMN_USAGE
 			WHERE TABLE_NAME = ? 
 			AND CONSTRAINT_NAME = 'PRIMARY'
-			AND TABLE_SCHEMA = DATABASE()
+			AND TABLE_SCHEMA = ?
 			ORDER BY ORDINAL_POSITION
 		`
-	case "postgres":
+	case "postgres", "pgx":
 		query = `
 			SELECT kcu.column_name
 			FROM information_schema.table_constraints tc
@@ -282,14 +543,14 @@ func (r *metadataReaderImpl) getPrimaryKeys(tableName string) ([]string, error)
 				AND tc.table_schema = kcu.table_schema
 			WHERE tc.constraint_type = 'PRIMARY KEY'
 				AND tc.table_name = $1
-				AND tc.table_schema = 'public'
+				AND tc.table_schema = $2
 			ORDER BY kcu.ordinal_position
 		`
 	default:
 		return nil, fmt.Errorf("unsupported driver: %s", r.driverName)
 	}
 
-	rows, err := r.db.Query(query, tableName)
+	rows, err := r.db.Query(query, tableName, schema)
 	if err != nil {
 		return nil, err
 	}
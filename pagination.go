@@ -0,0 +1,180 @@
+package pathsqlx
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// PathQueryPage is the path query that returns a page of (at most) limit root entities
+// with all their nested rows, and the cursor of the next page ("" on the last page).
+// Pages are ordered by the primary key of the root table, the first page has cursor "".
+func (db *DB) PathQueryPage(query string, arg interface{}, limit int, cursor string) (interface{}, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("page limit must be positive, got %d", limit)
+	}
+	db, err := db.withConnection()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.conn.Close()
+
+	analysis, err := AnalyzeQueryDialect(query, db.dialect())
+	if err != nil {
+		return nil, "", err
+	}
+	stmt, printer, err := parseQuery(query, analysis.Dialect)
+	if err != nil {
+		return nil, "", fmt.Errorf("query can't be paginated: %v", err)
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Limit != nil || len(sel.GroupBy) > 0 || sel.Having != nil || len(sel.From) != 1 {
+		return nil, "", fmt.Errorf("query can't be paginated: only a single SELECT without LIMIT and GROUP BY is supported")
+	}
+	steps, ok := flattenJoins(sel.From[0])
+	if !ok {
+		return nil, "", fmt.Errorf("query can't be paginated: unsupported FROM clause")
+	}
+	root := steps[0]
+	for _, step := range steps {
+		if step.alias == analysis.RootAlias() {
+			root = step
+		}
+	}
+	key, err := db.rootKey(root, printer)
+	if err != nil {
+		return nil, "", err
+	}
+	args, ok := db.namedArgs(arg)
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported argument type for pagination: %T", arg)
+	}
+	var after sqlparser.Expr
+	if cursor != "" {
+		args["pathsqlx_after"], err = decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &sqlparser.ComparisonExpr{Operator: sqlparser.GreaterThanStr, Left: key, Right: sqlparser.NewValArg([]byte(":pathsqlx_after"))}
+	}
+
+	// Fetch the root keys of the page and one more to detect the next page
+	keys := *sel
+	keys.Distinct = sqlparser.DistinctStr
+	keys.SelectExprs = sqlparser.SelectExprs{&sqlparser.AliasedExpr{Expr: key}}
+	keys.OrderBy = sqlparser.OrderBy{&sqlparser.Order{Expr: key, Direction: sqlparser.AscScr}}
+	keys.Limit = &sqlparser.Limit{Rowcount: sqlparser.NewIntVal([]byte(strconv.Itoa(limit + 1)))}
+	keys.Where = copyWhere(sel.Where, after)
+	rows, err := db.namedQuery(printer.String(&keys), args)
+	if err != nil {
+		return nil, "", err
+	}
+	values := []interface{}{}
+	for rows.Next() {
+		row, err := rows.SliceScan()
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		if b, ok := row[0].([]byte); ok {
+			row[0] = convertBytes(b)
+		}
+		values = append(values, row[0])
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(values) > limit {
+		values = values[:limit]
+		next, err = encodeCursor(values[limit-1])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Select all rows of the root keys in the page
+	page := *sel
+	if len(values) == 0 {
+		page.Where = copyWhere(sel.Where, &sqlparser.ComparisonExpr{Operator: sqlparser.EqualStr, Left: sqlparser.NewIntVal([]byte("1")), Right: sqlparser.NewIntVal([]byte("0"))})
+	} else {
+		args["pathsqlx_last"] = values[len(values)-1]
+		page.Where = copyWhere(sel.Where, after)
+		page.AddWhere(&sqlparser.ComparisonExpr{Operator: sqlparser.LessEqualStr, Left: key, Right: sqlparser.NewValArg([]byte(":pathsqlx_last"))})
+	}
+	page.OrderBy = append(sqlparser.OrderBy{&sqlparser.Order{Expr: key, Direction: sqlparser.AscScr}}, sel.OrderBy...)
+
+	result, err := db.pathQuery(printer.String(&page), analysis, args)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, next, nil
+}
+
+// rootKey returns the primary key column of the root table of a query, its name is that
+// of the catalog (quoted in PostgreSQL)
+func (db *DB) rootKey(root joinStep, printer *queryPrinter) (*sqlparser.ColName, error) {
+	tableName, ok := root.table.Expr.(sqlparser.TableName)
+	if !ok {
+		return nil, fmt.Errorf("query can't be paginated: the root must be a table")
+	}
+	metadata, err := db.metadataReader.GetTableMetadata(tableNameOf(tableName))
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.PrimaryKeys) != 1 {
+		return nil, fmt.Errorf("query can't be paginated: %s must have a single column primary key", tableNameOf(tableName))
+	}
+	return &sqlparser.ColName{
+		Name:      printer.quote(metadata.PrimaryKeys[0]),
+		Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(root.alias)},
+	}, nil
+}
+
+// copyWhere copies a WHERE clause (AddWhere modifies it) and adds a condition if not nil
+func copyWhere(where *sqlparser.Where, condition sqlparser.Expr) *sqlparser.Where {
+	sel := &sqlparser.Select{}
+	if where != nil {
+		sel.AddWhere(where.Expr)
+	}
+	if condition != nil {
+		sel.AddWhere(condition)
+	}
+	return sel.Where
+}
+
+// encodeCursor encodes the last root key of a page as an opaque cursor
+func encodeCursor(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor decodes a cursor into the root key it was created from
+func decodeCursor(cursor string) (interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", cursor)
+	}
+	if number, ok := value.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			return i, nil
+		}
+		return number.Float64()
+	}
+	return value, nil
+}
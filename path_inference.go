@@ -2,12 +2,15 @@ package pathsqlx
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 )
 
 // PathInferenceEngine infers JSON paths from query structure
 type PathInferenceEngine struct {
-	metadata MetadataReader
+	metadata    MetadataReader
+	polymorphic []PolymorphicRelation
+	dialect     Dialect
 }
 
 // NewPathInferenceEngine creates a new path inference engine
@@ -17,9 +20,24 @@ func NewPathInferenceEngine(metadata MetadataReader) *PathInferenceEngine {
 	}
 }
 
+// AddPolymorphicRelation declares a polymorphic association for all queries of the engine
+func (e *PathInferenceEngine) AddPolymorphicRelation(relation PolymorphicRelation) {
+	e.polymorphic = append(e.polymorphic, relation)
+}
+
+// forQuery returns an engine that also knows the derived tables (CTEs) of a query
+func (e *PathInferenceEngine) forQuery(analysis *QueryAnalysis) *PathInferenceEngine {
+	return &PathInferenceEngine{
+		metadata:    analysis.metadataReader(e.metadata),
+		polymorphic: e.polymorphic,
+		dialect:     analysis.Dialect,
+	}
+}
+
 // InferPaths generates JSON paths for query columns based on metadata and query structure
 func (e *PathInferenceEngine) InferPaths(analysis *QueryAnalysis, columns []string) (map[string]string, error) {
 	paths := make(map[string]string)
+	e = e.forQuery(analysis)
 
 	// Build cardinality map for each table alias
 	cardinality, err := e.buildCardinalityMap(analysis)
@@ -27,9 +45,21 @@ func (e *PathInferenceEngine) InferPaths(analysis *QueryAnalysis, columns []stri
 		return nil, err
 	}
 
+	// Determine the JSON keys of joined tables
+	keys, err := e.buildNestedKeys(analysis)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collapse many-to-many junction tables into their target tables
+	junctions := e.findJunctionTables(analysis, columns, cardinality)
+	for junctionAlias, targetAlias := range junctions {
+		cardinality[targetAlias] = cardinality[junctionAlias]
+	}
+
 	// Process each column
 	for _, col := range columns {
-		path, err := e.inferColumnPath(col, analysis, cardinality)
+		path, err := e.inferColumnPath(col, analysis, cardinality, junctions, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -43,33 +73,25 @@ func (e *PathInferenceEngine) InferPaths(analysis *QueryAnalysis, columns []stri
 func (e *PathInferenceEngine) buildCardinalityMap(analysis *QueryAnalysis) (map[string]bool, error) {
 	cardinality := make(map[string]bool)
 
+	// Pair the columns of USING and NATURAL joins with their tables
+	e.resolveJoinColumns(analysis)
+
 	// Get all foreign keys
-	allFKs, err := e.metadata.GetAllForeignKeys()
+	allFKs, err := e.getForeignKeys(analysis)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find the root table (the one in the FROM clause that's not joined)
-	rootAlias := ""
-	joinedAliases := make(map[string]bool)
-	for _, join := range analysis.Joins {
-		joinedAliases[join.RightAlias] = true
-	}
-
-	// Root is the table that's not the right side of any join
-	for alias := range analysis.Tables {
-		if !joinedAliases[alias] {
-			rootAlias = alias
-			break
-		}
-	}
+	// Find the root table (the first one in the FROM clause that's not joined)
+	rootAlias := analysis.RootAlias()
 
 	// Special case: if there's a PATH hint for $ (root), use it
 	if hintPath, ok := analysis.PathHints["$"]; ok {
 		if rootAlias == "" {
 			// No real table, use $ as the alias
 			rootAlias = "$"
-			analysis.Tables["$"] = "$"
+			analysis.addTable("$", "$")
+			analysis.Root = "$"
 		}
 		// Apply the hint to the root alias
 		analysis.PathHints[rootAlias] = hintPath
@@ -117,47 +139,373 @@ func (e *PathInferenceEngine) buildCardinalityMap(analysis *QueryAnalysis) (map[
 		}
 	}
 
+	// Tables with a TREE directive are nested from multiple rows, so they are arrays
+	for alias := range analysis.TreeHints {
+		if _, ok := analysis.Tables[alias]; ok {
+			cardinality[alias] = true
+		}
+	}
+
 	return cardinality, nil
 }
 
+// resolveJoinColumns pairs the columns of USING and NATURAL joins with the nearest table
+// on the left of the join that has them, NATURAL joins use all columns of the joined table
+func (e *PathInferenceEngine) resolveJoinColumns(analysis *QueryAnalysis) {
+	aliases := analysis.OrderedAliases()
+	for i := range analysis.Joins {
+		join := &analysis.Joins[i]
+		if len(join.Using) == 0 && !join.Natural {
+			continue
+		}
+
+		// The tables on the left of the join, nearest first
+		left := []string{}
+		for _, alias := range aliases {
+			if alias == join.RightAlias {
+				break
+			}
+			left = append([]string{alias}, left...)
+		}
+
+		columns := join.Using
+		if join.Natural {
+			metadata, err := e.metadata.GetTableMetadata(join.RightTable)
+			if err != nil {
+				continue
+			}
+			columns = metadata.Columns
+		}
+		onColumns := []JoinColumn{}
+		for _, column := range columns {
+			for _, alias := range left {
+				if e.hasColumn(analysis.Tables[alias], column) {
+					onColumns = append(onColumns, JoinColumn{LeftAlias: alias, LeftColumn: column, RightAlias: join.RightAlias, RightColumn: column})
+					break
+				}
+			}
+		}
+		if len(onColumns) == 0 {
+			continue
+		}
+		join.OnColumns = onColumns
+		join.LeftAlias = onColumns[0].LeftAlias
+		join.LeftTable = analysis.Tables[join.LeftAlias]
+	}
+}
+
+// hasColumn checks if the metadata of a table contains a column
+func (e *PathInferenceEngine) hasColumn(tableName, column string) bool {
+	metadata, err := e.metadata.GetTableMetadata(tableName)
+	if err != nil {
+		return false
+	}
+	for _, col := range metadata.Columns {
+		if e.dialect.sameIdentifier(col, column) {
+			return true
+		}
+	}
+	return false
+}
+
 // isOneToManyJoin determines if a join represents a one-to-many relationship
 func (e *PathInferenceEngine) isOneToManyJoin(join JoinInfo, allFKs []ForeignKey) bool {
-	// If no join columns parsed, assume LEFT JOIN implies array
+	// If no join columns parsed, assume LEFT (or FULL) JOIN implies array
 	if len(join.OnColumns) == 0 {
-		return join.JoinType == "LEFT" || join.JoinType == "LEFT OUTER"
-	}
-
-	// Check if there's a FK from right table to left table
-	// If so, it's a one-to-many (left -> many right)
-	for _, jc := range join.OnColumns {
-		for _, fk := range allFKs {
-			// Check if right table has FK to left table
-			if fk.FromTable == join.RightTable && fk.ToTable == join.LeftTable {
-				if (jc.RightAlias == join.RightAlias && jc.RightColumn == fk.FromColumn) ||
-					(jc.LeftAlias == join.RightAlias && jc.LeftColumn == fk.FromColumn) {
-					// Right table has FK to left = one-to-many
-					return true
+		return isOuterJoin(join)
+	}
+
+	// If the right table has a FK to the left table it's one-to-many (left -> many right),
+	// if the left table has a FK to the right table it's many-to-one
+	if fk, oneToMany := e.matchForeignKey(join, allFKs); fk != nil {
+		return oneToMany
+	}
+
+	// Default: if LEFT (or FULL) JOIN, treat as array
+	return isOuterJoin(join)
+}
+
+// isOuterJoin checks if the joined table of a join is optional
+func isOuterJoin(join JoinInfo) bool {
+	return join.JoinType == "LEFT" || join.JoinType == "LEFT OUTER" || join.JoinType == "FULL"
+}
+
+// getForeignKeys returns the foreign keys of the database and the polymorphic associations
+// Each join on the id column of a polymorphic association counts as a FK to the joined table.
+func (e *PathInferenceEngine) getForeignKeys(analysis *QueryAnalysis) ([]ForeignKey, error) {
+	allFKs, err := e.metadata.GetAllForeignKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	fks := append([]ForeignKey{}, allFKs...)
+	relations := e.getPolymorphicRelations(analysis)
+	for _, join := range analysis.Joins {
+		for _, jc := range join.OnColumns {
+			fromTable, _ := analysis.GetTableForAlias(jc.LeftAlias)
+			toTable, _ := analysis.GetTableForAlias(jc.RightAlias)
+			for _, relation := range relations {
+				if isTable(e.metadata, fromTable, "", relation.Table) && e.dialect.sameIdentifier(jc.LeftColumn, relation.IDColumn) {
+					fks = append(fks, ForeignKey{FromTable: fromTable, ToTable: toTable, Columns: []ColumnPair{{From: jc.LeftColumn, To: jc.RightColumn}}})
+				}
+				if isTable(e.metadata, toTable, "", relation.Table) && e.dialect.sameIdentifier(jc.RightColumn, relation.IDColumn) {
+					fks = append(fks, ForeignKey{FromTable: toTable, ToTable: fromTable, Columns: []ColumnPair{{From: jc.RightColumn, To: jc.LeftColumn}}})
 				}
 			}
+		}
+	}
+	return fks, nil
+}
 
-			// Check if left table has FK to right table
-			if fk.FromTable == join.LeftTable && fk.ToTable == join.RightTable {
-				if (jc.LeftAlias == join.LeftAlias && jc.LeftColumn == fk.FromColumn) ||
-					(jc.RightAlias == join.LeftAlias && jc.RightColumn == fk.FromColumn) {
-					// Left table has FK to right = many-to-one
-					return false
-				}
+// getPolymorphicRelations returns the polymorphic associations of the engine and the query hints
+func (e *PathInferenceEngine) getPolymorphicRelations(analysis *QueryAnalysis) []PolymorphicRelation {
+	relations := append([]PolymorphicRelation{}, e.polymorphic...)
+	for _, relation := range analysis.Polymorphic {
+		relations = append(relations, relation)
+	}
+	return relations
+}
+
+// polymorphicRelation returns the polymorphic association that a join follows from the
+// association to one of its tables, or nil when it doesn't follow one
+func (e *PathInferenceEngine) polymorphicRelation(join JoinInfo, analysis *QueryAnalysis) *PolymorphicRelation {
+	for _, relation := range e.getPolymorphicRelations(analysis) {
+		if !isTable(e.metadata, join.LeftTable, "", relation.Table) {
+			continue
+		}
+		for _, jc := range join.OnColumns {
+			if (jc.LeftAlias == join.LeftAlias && e.dialect.sameIdentifier(jc.LeftColumn, relation.IDColumn) && jc.RightAlias == join.RightAlias) ||
+				(jc.RightAlias == join.LeftAlias && e.dialect.sameIdentifier(jc.RightColumn, relation.IDColumn) && jc.LeftAlias == join.RightAlias) {
+				return &relation
+			}
+		}
+	}
+	return nil
+}
+
+// polymorphicType returns the type of the joined table of a polymorphic association: the
+// value that the join condition compares the type column to (e.g. 'post' in
+// "c.commentable_type = 'post'"), false when the condition doesn't compare it. The names
+// may be quoted with backticks or (in PostgreSQL) double quotes.
+func polymorphicType(join JoinInfo, relation *PolymorphicRelation) (string, bool) {
+	column := quotedNamePattern(join.LeftAlias) + `\s*\.\s*` + quotedNamePattern(relation.TypeColumn)
+	value := `'((?:[^'\\]|\\.|'')*)'`
+	re := regexp.MustCompile(`(?i)(?:^|[\s(])(?:` + column + `\s*=\s*` + value + `|` + value + `\s*=\s*` + column + `)`)
+	match := re.FindStringSubmatch(join.Condition)
+	if match == nil {
+		return "", false
+	}
+	return strings.Replace(match[1]+match[2], "''", "'", -1), true
+}
+
+// quotedNamePattern returns a regular expression that matches a name, bare or quoted
+func quotedNamePattern(name string) string {
+	backticks := strings.Replace(name, "`", "``", -1)
+	quotes := strings.Replace(name, `"`, `""`, -1)
+	return "(?:" + regexp.QuoteMeta(name) + "|`" + regexp.QuoteMeta(backticks) + "`|\"" + regexp.QuoteMeta(quotes) + "\")"
+}
+
+// polymorphicParents returns the nested parents of the polymorphic associations of a query
+// with the columns (source "alias.column") at the paths, a row only keeps the parent that
+// matches its type
+func (e *PathInferenceEngine) polymorphicParents(analysis *QueryAnalysis, columnMapping []string, paths []string) []polymorphicParent {
+	e = e.forQuery(analysis)
+	parents := []polymorphicParent{}
+	for _, join := range analysis.Joins {
+		relation := e.polymorphicRelation(join, analysis)
+		if relation == nil {
+			continue
+		}
+		parentPath, typePath := "", ""
+		for i, source := range columnMapping {
+			if i >= len(paths) || strings.LastIndex(paths[i], ".") < 0 {
+				continue
+			}
+			if strings.HasPrefix(source, join.RightAlias+".") && parentPath == "" {
+				parentPath = paths[i][:strings.LastIndex(paths[i], ".")]
+			}
+			if strings.HasPrefix(source, join.LeftAlias+".") && e.dialect.sameIdentifier(source[len(join.LeftAlias)+1:], relation.TypeColumn) && typePath == "" {
+				typePath = paths[i]
+			}
+		}
+		dot := strings.LastIndex(parentPath, ".")
+		if dot < 0 || strings.HasSuffix(parentPath, "[]") {
+			continue
+		}
+		parent := polymorphicParent{container: parentPath[:dot], key: parentPath[dot+1:]}
+		if value, ok := polymorphicType(join, relation); ok && strings.HasPrefix(typePath, parent.container+".") {
+			typeKey := strings.TrimPrefix(typePath, parent.container+".")
+			if !strings.Contains(typeKey, "[]") {
+				parent.typeKey = typeKey
+				parent.typeValue = value
 			}
 		}
+		parents = append(parents, parent)
 	}
+	return parents
+}
 
-	// Default: if LEFT JOIN, treat as array
-	return join.JoinType == "LEFT" || join.JoinType == "LEFT OUTER"
+// matchForeignKey finds the foreign key that a join condition follows
+// All columns of the FK must appear in the condition on the aliases of the join,
+// so self-joins, composite keys and multiple FKs to the same table are told apart.
+// Returns the FK (nil if none) and whether the right table references the left table.
+func (e *PathInferenceEngine) matchForeignKey(join JoinInfo, allFKs []ForeignKey) (*ForeignKey, bool) {
+	for i := range allFKs {
+		fk := &allFKs[i]
+		// Check if right table has FK to left table
+		if isTable(e.metadata, join.RightTable, fk.FromSchema, fk.FromTable) && isTable(e.metadata, join.LeftTable, fk.ToSchema, fk.ToTable) &&
+			joinColumnsMatch(e.dialect, join.OnColumns, fk, join.RightAlias, join.LeftAlias) {
+			return fk, true
+		}
+		// Check if left table has FK to right table
+		if isTable(e.metadata, join.LeftTable, fk.FromSchema, fk.FromTable) && isTable(e.metadata, join.RightTable, fk.ToSchema, fk.ToTable) &&
+			joinColumnsMatch(e.dialect, join.OnColumns, fk, join.LeftAlias, join.RightAlias) {
+			return fk, false
+		}
+	}
+	return nil, false
+}
+
+// joinColumnsMatch checks if every column pair of a FK is in the join columns
+func joinColumnsMatch(dialect Dialect, joinColumns []JoinColumn, fk *ForeignKey, fromAlias, toAlias string) bool {
+	if len(fk.Columns) == 0 {
+		return false
+	}
+	for _, pair := range fk.Columns {
+		found := false
+		for _, jc := range joinColumns {
+			if joinColumnMatches(dialect, jc, fromAlias, pair.From, toAlias, pair.To) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// joinColumnMatches checks if a join column pair is from.column = to.column (in either order)
+func joinColumnMatches(dialect Dialect, jc JoinColumn, fromAlias, fromColumn, toAlias, toColumn string) bool {
+	return (jc.LeftAlias == fromAlias && dialect.sameIdentifier(jc.LeftColumn, fromColumn) && jc.RightAlias == toAlias && dialect.sameIdentifier(jc.RightColumn, toColumn)) ||
+		(jc.RightAlias == fromAlias && dialect.sameIdentifier(jc.RightColumn, fromColumn) && jc.LeftAlias == toAlias && dialect.sameIdentifier(jc.LeftColumn, toColumn))
+}
+
+// buildNestedKeys determines the JSON key of each joined table
+// Tables are nested under their alias, except for many-to-one joins without an alias:
+// those are named after the FK column (e.g. "sender" for "sender_id").
+func (e *PathInferenceEngine) buildNestedKeys(analysis *QueryAnalysis) (map[string]string, error) {
+	keys := make(map[string]string)
+
+	allFKs, err := e.getForeignKeys(analysis)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, join := range analysis.Joins {
+		// Polymorphic parents are nested under their alias
+		if e.polymorphicRelation(join, analysis) != nil {
+			continue
+		}
+		if join.RightAlias != join.RightTable {
+			continue
+		}
+		fk, oneToMany := e.matchForeignKey(join, allFKs)
+		if fk == nil || oneToMany || len(fk.Columns) != 1 || !strings.HasSuffix(fk.Columns[0].From, "_id") {
+			continue
+		}
+		key := strings.TrimSuffix(fk.Columns[0].From, "_id")
+		if _, exists := analysis.Tables[key]; !exists {
+			keys[join.RightAlias] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// findJunctionTables finds many-to-many junction tables that can be skipped in the result
+// A junction is collapsed when it joins a parent (one-to-many) to a target (many-to-one),
+// has no PATH hint and none of its payload columns are selected.
+// Returns a map of junction alias to target alias.
+func (e *PathInferenceEngine) findJunctionTables(analysis *QueryAnalysis, columns []string, cardinality map[string]bool) map[string]string {
+	junctions := make(map[string]string)
+
+	rootAlias := analysis.RootAlias()
+	for _, join := range analysis.Joins {
+		junctionAlias := join.RightAlias
+		if junctionAlias == rootAlias || join.LeftAlias == "" || !cardinality[junctionAlias] {
+			continue
+		}
+		if _, ok := analysis.PathHints[junctionAlias]; ok {
+			continue
+		}
+
+		// The junction must be the parent of exactly one many-to-one join
+		targetAlias := ""
+		targets := 0
+		for _, child := range analysis.Joins {
+			if child.LeftAlias == junctionAlias && child.RightAlias != junctionAlias {
+				targetAlias = child.RightAlias
+				targets++
+			}
+		}
+		if targets != 1 || cardinality[targetAlias] {
+			continue
+		}
+
+		metadata, err := e.metadata.GetTableMetadata(join.RightTable)
+		if err != nil || !isJunctionTable(metadata) {
+			continue
+		}
+
+		// Only the key columns of the junction may be selected
+		keys := make(map[string]bool)
+		for _, pk := range metadata.PrimaryKeys {
+			keys[strings.ToLower(pk)] = true
+		}
+		hasPayload := false
+		for _, col := range columns {
+			parts := strings.Split(col, ".")
+			if len(parts) == 2 && parts[0] == junctionAlias && !keys[strings.ToLower(parts[1])] {
+				hasPayload = true
+				break
+			}
+		}
+		if !hasPayload {
+			junctions[junctionAlias] = targetAlias
+		}
+	}
+
+	return junctions
+}
+
+// isJunctionTable checks whether a table is a pure many-to-many junction table:
+// it has two foreign keys that together form the primary key
+func isJunctionTable(metadata *TableMetadata) bool {
+	if len(metadata.ForeignKeys) != 2 {
+		return false
+	}
+	fkColumns := make(map[string]bool)
+	for _, fk := range metadata.ForeignKeys {
+		for _, pair := range fk.Columns {
+			fkColumns[pair.From] = true
+		}
+	}
+	if len(metadata.PrimaryKeys) != len(fkColumns) {
+		return false
+	}
+	for _, pk := range metadata.PrimaryKeys {
+		if !fkColumns[pk] {
+			return false
+		}
+	}
+	return true
 }
 
 // inferColumnPath generates the JSON path for a single column
 // PATH hints apply only to table aliases, not individual columns
-func (e *PathInferenceEngine) inferColumnPath(column string, analysis *QueryAnalysis, cardinality map[string]bool) (string, error) {
+func (e *PathInferenceEngine) inferColumnPath(column string, analysis *QueryAnalysis, cardinality map[string]bool, junctions, keys map[string]string) (string, error) {
 	// Parse column format: "alias.column" or "column"
 	parts := strings.Split(column, ".")
 
@@ -214,153 +562,110 @@ func (e *PathInferenceEngine) inferColumnPath(column string, analysis *QueryAnal
 		return "$." + colName, nil
 	}
 
-	// For queries with joins, need to check if we have path hints
-	// If the root table has a path hint, nested tables should be relative to it
-	rootAlias := e.findRootAlias(analysis)
-	if rootHint, ok := analysis.PathHints[rootAlias]; ok {
-		// Build path relative to the root hint
-		if alias == rootAlias {
-			// This is the root table
-			if cardinality[alias] {
-				if !strings.HasSuffix(rootHint, "[]") {
-					return rootHint + "[]." + colName, nil
-				}
-			}
-			return rootHint + "." + colName, nil
-		} else {
-			// This is a joined table - nest it under root
-			if cardinality[rootAlias] {
-				// Root is array
-				if cardinality[alias] {
-					// Nested table is also array
-					if !strings.HasSuffix(rootHint, "[]") {
-						return rootHint + "[]." + alias + "[]." + colName, nil
-					}
-					return rootHint + "." + alias + "[]." + colName, nil
-				}
-				// Nested table is object
-				if !strings.HasSuffix(rootHint, "[]") {
-					return rootHint + "[]." + alias + "." + colName, nil
-				}
-				return rootHint + "." + alias + "." + colName, nil
-			} else {
-				// Root is object
-				if cardinality[alias] {
-					return rootHint + "." + alias + "[]." + colName, nil
-				}
-				return rootHint + "." + alias + "." + colName, nil
-			}
-		}
-	}
-
-	// No path hints - use default behavior
-	path := e.buildPathToTable(alias, analysis, cardinality)
+	// For queries with joins, follow the join tree from the root to this table
+	path := e.buildPathToTable(alias, analysis, cardinality, junctions, keys)
 	return path + "." + colName, nil
 }
 
-// findRootAlias finds the root table alias (the one not on right side of any join)
-func (e *PathInferenceEngine) findRootAlias(analysis *QueryAnalysis) string {
-	joinedAliases := make(map[string]bool)
-	for _, join := range analysis.Joins {
-		joinedAliases[join.RightAlias] = true
-	}
-	for alias := range analysis.Tables {
-		if !joinedAliases[alias] {
-			return alias
-		}
-	}
-	return ""
-}
-
 // guessAliasForColumn tries to determine which table a column belongs to
 func (e *PathInferenceEngine) guessAliasForColumn(column string, analysis *QueryAnalysis) string {
+	aliases := analysis.OrderedAliases()
+
 	// Return the first table if only one exists
-	if len(analysis.Tables) == 1 {
-		for alias := range analysis.Tables {
-			return alias
-		}
+	if len(aliases) == 1 {
+		return aliases[0]
 	}
 
-	// Try to find the column in table metadata
-	for alias, tableName := range analysis.Tables {
-		metadata, err := e.metadata.GetTableMetadata(tableName)
+	// Try to find the column in table metadata, starting at the root
+	rootAlias := analysis.RootAlias()
+	for _, alias := range append([]string{rootAlias}, aliases...) {
+		metadata, err := e.metadata.GetTableMetadata(analysis.Tables[alias])
 		if err != nil {
 			continue
 		}
 		for _, col := range metadata.Columns {
-			if col == column {
+			if e.dialect.sameIdentifier(col, column) {
 				return alias
 			}
 		}
 	}
 
-	// Default to first table
-	for alias := range analysis.Tables {
-		return alias
-	}
-
-	return ""
+	// Default to the root table
+	return rootAlias
 }
 
 // buildPathToTable constructs the JSON path from root to a specific table
-func (e *PathInferenceEngine) buildPathToTable(targetAlias string, analysis *QueryAnalysis, cardinality map[string]bool) string {
-	// Start with root
-	path := "$"
-
-	// Find path through joins
+func (e *PathInferenceEngine) buildPathToTable(targetAlias string, analysis *QueryAnalysis, cardinality map[string]bool, junctions, keys map[string]string) string {
+	rootAlias := analysis.RootAlias()
 	visited := make(map[string]bool)
-	path = e.buildPathRecursive(targetAlias, analysis, cardinality, visited)
-
-	return path
+	return e.buildPathRecursive(targetAlias, rootAlias, analysis, cardinality, junctions, keys, visited)
 }
 
-// buildPathRecursive recursively builds the path by following joins
-func (e *PathInferenceEngine) buildPathRecursive(targetAlias string, analysis *QueryAnalysis, cardinality map[string]bool, visited map[string]bool) string {
-	if visited[targetAlias] {
-		return ""
+// buildPathRecursive recursively builds the path by following joins from the target up to the root
+// Each table is nested inside the table on the left side of its join, with an array marker
+// when that join is one-to-many. Tables with a PATH hint start a new absolute path.
+func (e *PathInferenceEngine) buildPathRecursive(targetAlias, rootAlias string, analysis *QueryAnalysis, cardinality map[string]bool, junctions, keys map[string]string, visited map[string]bool) string {
+	// Columns of a collapsed junction table are placed on its target table
+	if junctionTarget, ok := junctions[targetAlias]; ok && !visited[junctionTarget] {
+		return e.buildPathRecursive(junctionTarget, rootAlias, analysis, cardinality, junctions, keys, visited)
 	}
-	visited[targetAlias] = true
 
-	// Find the root table alias (the one that's not on the right side of any join)
-	rootAlias := ""
-	joinedAliases := make(map[string]bool)
-	for _, join := range analysis.Joins {
-		joinedAliases[join.RightAlias] = true
+	marker := ""
+	if cardinality[targetAlias] {
+		marker = "[]"
 	}
-	for alias := range analysis.Tables {
-		if !joinedAliases[alias] {
-			rootAlias = alias
-			break
+
+	// A PATH hint places the table at an absolute path
+	if hintPath, ok := analysis.PathHints[targetAlias]; ok {
+		if strings.HasSuffix(hintPath, "[]") {
+			return hintPath
 		}
+		return hintPath + marker
 	}
 
-	// Check if this is the root table
-	isRoot := (targetAlias == rootAlias)
+	// The root table is a property of each result row
+	if targetAlias == rootAlias {
+		return e.buildChildBase(rootAlias, rootAlias, analysis, cardinality, junctions, keys, visited) + "." + targetAlias
+	}
 
-	if isRoot {
-		// This is the root table
-		if cardinality[targetAlias] {
-			return "$[]." + targetAlias
+	// Find the parent table from the join, fall back to the root if unknown
+	visited[targetAlias] = true
+	parentAlias := rootAlias
+	if join := analysis.GetJoinForTable(targetAlias); join != nil && join.LeftAlias != "" {
+		if _, ok := analysis.Tables[join.LeftAlias]; ok && !visited[join.LeftAlias] {
+			parentAlias = join.LeftAlias
 		}
-		return "$." + targetAlias
 	}
 
-	// This is a joined table - place it at the root level (flat structure)
-	// For flat joins, all tables are siblings within each result row
-	if cardinality[rootAlias] {
-		// Root is an array, so tables are within each array element
-		if cardinality[targetAlias] {
-			// This table is one-to-many relative to parent, so it gets an array marker
-			return "$[]." + targetAlias + "[]"
+	// A collapsed junction table is skipped, the target is nested in the junction's parent
+	if _, ok := junctions[parentAlias]; ok {
+		junctionAlias := parentAlias
+		visited[junctionAlias] = true
+		parentAlias = rootAlias
+		if join := analysis.GetJoinForTable(junctionAlias); join != nil && join.LeftAlias != "" && !visited[join.LeftAlias] {
+			parentAlias = join.LeftAlias
 		}
-		return "$[]." + targetAlias
 	}
 
-	// Root is object
-	if cardinality[targetAlias] {
-		return "$." + targetAlias + "[]"
+	key := targetAlias
+	if derivedKey, ok := keys[targetAlias]; ok {
+		key = derivedKey
+	}
+
+	return e.buildChildBase(parentAlias, rootAlias, analysis, cardinality, junctions, keys, visited) + "." + key + marker
+}
+
+// buildChildBase returns the path under which the tables joined to the parent are placed
+// Tables joined to an unhinted root are siblings of the root within each result row,
+// all other tables are nested inside their parent.
+func (e *PathInferenceEngine) buildChildBase(parentAlias, rootAlias string, analysis *QueryAnalysis, cardinality map[string]bool, junctions, keys map[string]string, visited map[string]bool) string {
+	if _, ok := analysis.PathHints[parentAlias]; !ok && parentAlias == rootAlias {
+		if cardinality[rootAlias] {
+			return "$[]"
+		}
+		return "$"
 	}
-	return "$." + targetAlias
+	return e.buildPathRecursive(parentAlias, rootAlias, analysis, cardinality, junctions, keys, visited)
 }
 
 // InferPathsWithFallback is a helper that provides fallback behavior
@@ -7,8 +7,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/iancoleman/orderedmap"
@@ -29,6 +29,23 @@ type (
 type DB struct {
 	*sqlx.DB
 	metadataReader MetadataReader
+	polymorphic    []PolymorphicRelation
+	conn           *sql.Conn // connection of a single path query, nil for the pool
+
+	// SplitQueries fetches every one-to-many LEFT JOIN branch with a separate query
+	// (using an IN list of parent keys), so sibling arrays don't multiply each other's
+	// rows. Queries that can't be split are executed as a single query.
+	SplitQueries bool
+
+	// Limits that abort a path query with a *LimitError, zero means no limit. MaxRows and
+	// MaxResultBytes (an estimate of the size of the values) apply to the rows of each
+	// query, MaxDepth to the nesting of the paths. MaxSiblingArrays limits the one-to-many
+	// joins under the same parent, as their rows are multiplied (set it to 1 to refuse
+	// any row multiplication).
+	MaxRows          int
+	MaxResultBytes   int
+	MaxDepth         int
+	MaxSiblingArrays int
 }
 
 // Open opens a database connection. This is analogous to sql.Open, but returns a *pathsqlx.DB instead.
@@ -75,6 +92,21 @@ func NewDb(db *sql.DB, driverName string) *DB {
 	return &DB{DB: sqlx.NewDb(db, driverName)}
 }
 
+// AddPolymorphicRelation declares a polymorphic association (a type and id column
+// referencing one of several tables) that is used to infer the paths of all queries.
+func (db *DB) AddPolymorphicRelation(relation PolymorphicRelation) {
+	db.polymorphic = append(db.polymorphic, relation)
+}
+
+// newPathInferenceEngine creates a path inference engine with the declared relations
+func (db *DB) newPathInferenceEngine() *PathInferenceEngine {
+	engine := NewPathInferenceEngine(db.metadataReader)
+	for _, relation := range db.polymorphic {
+		engine.AddPolymorphicRelation(relation)
+	}
+	return engine
+}
+
 // ByRevLen is for reverse length-based sort.
 type ByRevLen []string
 
@@ -82,42 +114,6 @@ func (a ByRevLen) Len() int           { return len(a) }
 func (a ByRevLen) Less(i, j int) bool { return len(a[i]) > len(a[j]) }
 func (a ByRevLen) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
-// splitSelectColumns splits a SELECT clause by commas while respecting parentheses
-func splitSelectColumns(selectClause string) []string {
-	var result []string
-	var current strings.Builder
-	depth := 0
-
-	for _, ch := range selectClause {
-		switch ch {
-		case '(':
-			depth++
-			current.WriteRune(ch)
-		case ')':
-			depth--
-			current.WriteRune(ch)
-		case ',':
-			if depth == 0 {
-				// Top-level comma, split here
-				result = append(result, current.String())
-				current.Reset()
-			} else {
-				// Inside parentheses, keep the comma
-				current.WriteRune(ch)
-			}
-		default:
-			current.WriteRune(ch)
-		}
-	}
-
-	// Add the last part
-	if current.Len() > 0 {
-		result = append(result, current.String())
-	}
-
-	return result
-}
-
 func (db *DB) getPaths(columns []string) ([]string, error) {
 	paths := []string{}
 	path := "$[]"
@@ -136,14 +132,47 @@ func (db *DB) getPaths(columns []string) ([]string, error) {
 }
 
 func (db *DB) getAllRecords(rows *sqlx.Rows, paths []string) ([]*orderedmap.OrderedMap, error) {
+	return db.getRecords(rows, [][]string{paths})
+}
+
+// getRecords reads the rows as records of paths and values, with multiple (UNION) branches
+// the last column is the branch of the row that determines its paths
+func (db *DB) getRecords(rows *sqlx.Rows, branchPaths [][]string) ([]*orderedmap.OrderedMap, error) {
+	defer rows.Close()
+	for _, paths := range branchPaths {
+		if err := db.checkPathLimits(paths); err != nil {
+			return nil, err
+		}
+	}
 	records := []*orderedmap.OrderedMap{}
+	size := 0
 	for rows.Next() {
+		if db.MaxRows > 0 && len(records) >= db.MaxRows {
+			return nil, &LimitError{Limit: "MaxRows", Max: db.MaxRows}
+		}
 		row, err := rows.SliceScan()
 		if err != nil {
 			return records, err
 		}
+		paths := branchPaths[0]
+		if len(branchPaths) > 1 {
+			value := row[len(row)-1]
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			branch, err := strconv.Atoi(fmt.Sprint(value))
+			if err != nil || branch < 0 || branch >= len(branchPaths) {
+				return nil, fmt.Errorf("invalid UNION branch: %v", row[len(row)-1])
+			}
+			paths = branchPaths[branch]
+			row = row[:len(row)-1]
+		}
 		record := orderedmap.New()
 		for i, value := range row {
+			size += len(paths[i]) + valueSize(value)
+			if db.MaxResultBytes > 0 && size > db.MaxResultBytes {
+				return nil, &LimitError{Limit: "MaxResultBytes", Max: db.MaxResultBytes}
+			}
 			// Convert []byte to appropriate type for proper JSON serialization
 			if b, ok := value.([]byte); ok {
 				value = convertBytes(b)
@@ -169,7 +198,7 @@ func (db *DB) getAllRecords(rows *sqlx.Rows, paths []string) ([]*orderedmap.Orde
 		}
 		records = append(records, record)
 	}
-	return records, nil
+	return records, rows.Err()
 }
 
 // convertBytes converts []byte to the appropriate Go type (int64, float64, or string)
@@ -224,7 +253,7 @@ func (db *DB) groupBySeparator(records []*orderedmap.OrderedMap, separator strin
 
 func (db *DB) addHashes(records []*orderedmap.OrderedMap) ([]*orderedmap.OrderedMap, error) {
 	results := []*orderedmap.OrderedMap{}
-	for _, record := range records {
+	for row, record := range records {
 		mapping := map[string]string{}
 		for _, key := range record.Keys() {
 			part, _ := record.Get(key)
@@ -235,6 +264,11 @@ func (db *DB) addHashes(records []*orderedmap.OrderedMap) ([]*orderedmap.Ordered
 			if err != nil {
 				return nil, err
 			}
+			// A missing (NULL) parent of an orphan row (e.g. from a FULL JOIN) is never
+			// merged with the missing parents of other rows
+			if isOrphan(record, key) {
+				bytes = append(bytes, fmt.Sprintf("#%d", row)...)
+			}
 			md5 := md5.Sum(bytes)
 			hash := hex.EncodeToString(md5[:])
 			mapping[key] = key[:len(key)-2] + ".!" + hash + "!"
@@ -285,22 +319,28 @@ func (db *DB) combineIntoTree(records []*orderedmap.OrderedMap, separator string
 	return nextMap, nil
 }
 
-func (db *DB) removeHashes(tree *orderedmap.OrderedMap, path string) (interface{}, error) {
+func (db *DB) removeHashes(tree *orderedmap.OrderedMap, path string, outer map[string]string) (interface{}, error) {
 	values := orderedmap.New()
 	trees := orderedmap.New()
 	results := []interface{}{}
+	isArray := false
 	for _, key := range tree.Keys() {
 		value, _ := tree.Get(key)
 		valueMap, success := value.(*orderedmap.OrderedMap)
 		if success {
 			if key[:1] == "!" && key[len(key)-1:] == "!" {
-				result, err := db.removeHashes(valueMap, path+"[]")
+				isArray = true
+				result, err := db.removeHashes(valueMap, path+"[]", outer)
 				if err != nil {
 					return nil, err
 				}
+				// An element without any value is the missing side of an outer join row
+				if outer[path+"[]"] != "" && isEmptyValue(result) {
+					continue
+				}
 				results = append(results, result)
 			} else {
-				result, err := db.removeHashes(valueMap, path+"."+key)
+				result, err := db.removeHashes(valueMap, path+"."+key, outer)
 				if err != nil {
 					return nil, err
 				}
@@ -310,7 +350,7 @@ func (db *DB) removeHashes(tree *orderedmap.OrderedMap, path string) (interface{
 			values.Set(key, value)
 		}
 	}
-	if len(results) > 0 {
+	if isArray {
 		hidden := append(values.Keys(), trees.Keys()...)
 		if len(hidden) > 0 {
 			return nil, fmt.Errorf(
@@ -329,23 +369,212 @@ func (db *DB) removeHashes(tree *orderedmap.OrderedMap, path string) (interface{
 		value, _ := trees.Get(key)
 		mapResults.Set(key, value)
 	}
+	// An object of an outer-joined table without any value is a missing parent
+	if outer[path] != "" && !strings.HasSuffix(path, "[]") && isAllNull(mapResults) {
+		return nil, nil
+	}
 	return mapResults, nil
 }
 
+// isOrphan checks if the part of a record at an array level is a missing parent: all its
+// values are NULL while a nested level has values
+func isOrphan(record *orderedmap.OrderedMap, key string) bool {
+	part, _ := record.Get(key)
+	object, ok := part.(*orderedmap.OrderedMap)
+	if !ok || !isAllNull(object) {
+		return false
+	}
+	for _, other := range record.Keys() {
+		if other == key || !strings.HasPrefix(other, key) {
+			continue
+		}
+		nested, _ := record.Get(other)
+		if nestedObject, ok := nested.(*orderedmap.OrderedMap); ok && !isAllNull(nestedObject) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyValue checks whether a value has no data: NULL, an empty array or an object
+// with only empty values
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(v) == 0
+	case *orderedmap.OrderedMap:
+		for _, key := range v.Keys() {
+			if nested, _ := v.Get(key); !isEmptyValue(nested) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isAllNull checks whether all values of an object are NULL
+func isAllNull(object *orderedmap.OrderedMap) bool {
+	for _, key := range object.Keys() {
+		if value, _ := object.Get(key); value != nil {
+			return false
+		}
+	}
+	return len(object.Keys()) > 0
+}
+
+// pathSteps splits a path into the steps to walk the result, e.g. "$.posts[].comments"
+// becomes "posts", "[]" and "comments", a trailing "[]" is kept as the last step
+func pathSteps(path string) []string {
+	steps := []string{}
+	for _, part := range strings.Split(strings.TrimPrefix(path, "$"), ".") {
+		name := strings.TrimSuffix(part, "[]")
+		if name != "" {
+			steps = append(steps, name)
+		}
+		if name != part {
+			steps = append(steps, "[]")
+		}
+	}
+	return steps
+}
+
+// applyAtPath walks the steps into the result and replaces every value found at the end
+// A "[]" step applies the remaining steps to each element of an array.
+func applyAtPath(value interface{}, steps []string, apply func(interface{}) (interface{}, error)) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if len(steps) == 0 {
+		return apply(value)
+	}
+	if steps[0] == "[]" {
+		elements, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+		for i, element := range elements {
+			result, err := applyAtPath(element, steps[1:], apply)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = result
+		}
+		return elements, nil
+	}
+	object, ok := value.(*orderedmap.OrderedMap)
+	if !ok {
+		return value, nil
+	}
+	child, found := object.Get(steps[0])
+	if !found {
+		return value, nil
+	}
+	result, err := applyAtPath(child, steps[1:], apply)
+	if err != nil {
+		return nil, err
+	}
+	object.Set(steps[0], result)
+	return object, nil
+}
+
 // PathQuery is the query that returns nested paths
 func (db *DB) PathQuery(query string, arg interface{}) (interface{}, error) {
-	// Initialize metadata reader if not already done
+	// Analyze query for structure and hints
+	analysis, err := AnalyzeQueryDialect(query, db.dialect())
+	if err != nil {
+		return nil, err
+	}
+	db, err = db.withConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer db.conn.Close()
+	return db.pathQuery(query, analysis, arg)
+}
+
+// initMetadataReader initializes the metadata reader if not already done
+func (db *DB) initMetadataReader() {
 	if db.metadataReader == nil {
 		db.metadataReader = NewMetadataReader(db.DB.DB, db.DriverName())
 	}
+}
 
-	// Analyze query for structure and hints
-	analysis, err := AnalyzeQuery(query)
+// withConnection returns a copy of the database that executes the queries of one path
+// query on a single connection, the table names are resolved with the search_path of
+// that connection. Close the connection when the path query is done.
+func (db *DB) withConnection() (*DB, error) {
+	db.initMetadataReader()
+	ctx := context.Background()
+	conn, err := db.DB.DB.Conn(ctx)
 	if err != nil {
 		return nil, err
 	}
+	query := *db
+	query.conn = conn
+	if reader, ok := db.metadataReader.(*metadataReaderImpl); ok {
+		query.metadataReader, err = reader.forConnection(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &query, nil
+}
 
-	rows, err := db.NamedQuery(query, arg)
+// namedQuery executes a named query on the connection of the path query
+func (db *DB) namedQuery(query string, arg interface{}) (*sqlx.Rows, error) {
+	if db.conn == nil {
+		return db.NamedQuery(query, arg)
+	}
+	query, args, err := db.BindNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.conn.QueryContext(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlx.Rows{Rows: rows, Mapper: db.Mapper}, nil
+}
+
+// InvalidateMetadata clears the cached table metadata and foreign keys, call it after
+// changing the schema of the database
+func (db *DB) InvalidateMetadata() {
+	if db.metadataReader != nil {
+		db.metadataReader.InvalidateCache()
+	}
+}
+
+// pathQuery executes a (rewritten) query using the analysis of the original path query
+func (db *DB) pathQuery(query string, analysis *QueryAnalysis, arg interface{}) (interface{}, error) {
+	db.initMetadataReader()
+
+	// Attribute the columns of * and alias.* to their tables
+	analysis.ExpandStars(db.metadataReader)
+	for _, branch := range analysis.Branches {
+		branch.ExpandStars(db.metadataReader)
+	}
+
+	// Fetch one-to-many branches with separate queries when possible
+	if db.SplitQueries {
+		if plan, ok := db.planSplitQuery(query, analysis); ok {
+			return db.runSplitQuery(plan, arg, analysis)
+		}
+	}
+
+	// Place the rows of each UNION branch at the paths of that branch
+	if len(analysis.Branches) > 1 && db.hasBranchPaths(analysis) {
+		union, err := addUnionBranchColumn(query, len(analysis.Branches), analysis.Dialect)
+		if err != nil {
+			return nil, err
+		}
+		return db.runUnionQuery(union, analysis, arg)
+	}
+
+	rows, err := db.namedQuery(query, arg)
 	if err != nil {
 		return nil, err
 	}
@@ -354,22 +583,43 @@ func (db *DB) PathQuery(query string, arg interface{}) (interface{}, error) {
 		return nil, err
 	}
 
+	columnMapping, paths, err := db.columnPaths(analysis, columns)
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+
+	records, err := db.getAllRecords(rows, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.combineRecordsIntoTree(records, paths, outerPaths(analysis, columnMapping, paths))
+	if err != nil {
+		return nil, err
+	}
+	result, err = selectPolymorphicParents(result, db.newPathInferenceEngine().polymorphicParents(analysis, columnMapping, paths))
+	if err != nil {
+		return nil, err
+	}
+
+	return db.applyDirectives(result, analysis, columns, columnMapping, paths)
+}
+
+// columnPaths maps the result columns of a query to their sources ("alias.column") and
+// their paths, explicit paths are used when a column name starts with "$"
+func (db *DB) columnPaths(analysis *QueryAnalysis, columns []string) ([]string, []string, error) {
 	// Map actual column names to their inferred sources
 	columnMapping := make([]string, len(columns))
 	hasExplicitPaths := false
 
-	// Build a map of column positions from the query
-	// by checking SELECT clause for table.column patterns
-	selectPattern := regexp.MustCompile(`(?i)SELECT\s+(.+?)\s+(?:FROM|$)`)
-	selectMatches := selectPattern.FindStringSubmatch(query)
-	var selectColumns []string
-	if len(selectMatches) >= 2 {
-		selectClause := selectMatches[1]
-		// Remove comments
-		commentPattern := regexp.MustCompile(`--[^\n]*`)
-		selectClause = commentPattern.ReplaceAllString(selectClause, "")
-		// Split by comma respecting parentheses
-		selectColumns = splitSelectColumns(selectClause)
+	// Columns after a star can't be matched to the SELECT clause by position
+	selectColumns := analysis.Columns
+	for i, column := range selectColumns {
+		if column.Star {
+			selectColumns = selectColumns[:i]
+			break
+		}
 	}
 
 	for i, col := range columns {
@@ -377,62 +627,160 @@ func (db *DB) PathQuery(query string, arg interface{}) (interface{}, error) {
 		if strings.HasPrefix(col, "$") {
 			columnMapping[i] = col
 			hasExplicitPaths = true
+		} else if i < len(selectColumns) {
+			// Qualified columns are mapped to "alias.column"
+			columnMapping[i] = selectColumns[i].Source(col, analysis)
 		} else {
-			// Try to match with SELECT clause to find table.column format
-			matched := false
-			if i < len(selectColumns) {
-				selectCol := strings.TrimSpace(selectColumns[i])
-				// Check if it's table.column format
-				if strings.Contains(selectCol, ".") && !strings.Contains(selectCol, "(") {
-					parts := strings.SplitN(selectCol, ".", 2)
-					if len(parts) == 2 {
-						tableAlias := strings.TrimSpace(parts[0])
-						// Verify this table exists in our analysis
-						if _, ok := analysis.Tables[tableAlias]; ok {
-							columnMapping[i] = tableAlias + "." + col
-							matched = true
-						}
-					}
-				}
-			}
-
-			if !matched {
-				// Column doesn't match table.column pattern, just use as-is
-				columnMapping[i] = col
-			}
+			columnMapping[i] = col
 		}
 	}
 
 	// If we have explicit paths, use the old getPaths logic
-	var paths []string
 	if hasExplicitPaths {
-		paths, err = db.getPaths(columns)
+		paths, err := db.getPaths(columns)
+		if err != nil {
+			return nil, nil, err
+		}
+		return columnMapping, paths, nil
+	}
+
+	// Infer paths automatically
+	engine := db.newPathInferenceEngine()
+	inferredPaths := engine.InferPathsWithFallback(analysis, columnMapping)
+
+	// Convert to path array format
+	paths := make([]string, len(columns))
+	for i, col := range columns {
+		if path, ok := inferredPaths[columnMapping[i]]; ok {
+			paths[i] = path
+		} else {
+			paths[i] = "$[]." + col
+		}
+	}
+	return columnMapping, paths, nil
+}
+
+// outerPaths returns the paths of the objects and the array elements of the outer-joined
+// tables of a query (e.g. "$[].p" and "$[].c[]") with their join type, they are missing
+// when all their values are NULL
+func outerPaths(analysis *QueryAnalysis, columnMapping []string, paths []string) map[string]string {
+	aliases := analysis.outerJoinedAliases()
+	outer := make(map[string]string)
+	for i, source := range columnMapping {
+		if i >= len(paths) || strings.LastIndex(paths[i], ".") < 0 {
+			continue
+		}
+		for alias, joinType := range aliases {
+			if strings.HasPrefix(source, alias+".") {
+				outer[paths[i][:strings.LastIndex(paths[i], ".")]] = joinType
+			}
+		}
+	}
+	return outer
+}
+
+// applyDirectives applies the LIMIT and TREE directives of a query to its nested result
+func (db *DB) applyDirectives(result interface{}, analysis *QueryAnalysis, columns []string, columnMapping []string, paths []string) (interface{}, error) {
+	var err error
+
+	// Limit and order nested arrays for LIMIT directives
+	for _, hint := range analysis.LimitHints {
+		result, err = db.limitArrays(result, hint, columnMapping, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Build recursive hierarchies for TREE directives
+	for _, hint := range analysis.TreeHints {
+		result, err = db.buildTrees(result, hint, columns, columnMapping, paths)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		// Infer paths automatically
-		engine := NewPathInferenceEngine(db.metadataReader)
-		inferredPaths := engine.InferPathsWithFallback(analysis, columnMapping)
-
-		// Convert to path array format
-		paths = make([]string, len(columns))
-		for i, col := range columns {
-			if i < len(columnMapping) {
-				if path, ok := inferredPaths[columnMapping[i]]; ok {
-					paths[i] = path
-				} else {
-					paths[i] = "$[]." + col
+	}
+	return result, nil
+}
+
+// emptyResult returns the result of a query without rows: the outer arrays are empty,
+// e.g. {"posts":[]} for "$.posts[].id", otherwise it is an empty array (like for rows
+// without array paths)
+func emptyResult(paths []string) interface{} {
+	object := orderedmap.New()
+	for _, path := range paths {
+		steps := pathSteps(path)
+		if len(steps) > 0 && steps[0] == "[]" {
+			return []interface{}{}
+		}
+		if len(steps) > 1 && steps[1] == "[]" {
+			object.Set(steps[0], []interface{}{})
+		}
+	}
+	if len(object.Keys()) == 0 {
+		return []interface{}{}
+	}
+	return object
+}
+
+// polymorphicParent is a parent of a polymorphic association that is nested in the objects
+// at the container path, only the rows of its type keep it
+type polymorphicParent struct {
+	container string // path of the objects with the parent, e.g. "$[]"
+	key       string // key of the parent in these objects
+	typeKey   string // path of the type column from the container, e.g. "c.commentable_type"
+	typeValue string // type of the parent, from the join condition
+}
+
+// selectPolymorphicParents removes the polymorphic parents that don't match the type of
+// their row, without a (selected) type column the parents without values are removed
+func selectPolymorphicParents(result interface{}, parents []polymorphicParent) (interface{}, error) {
+	for _, parent := range parents {
+		var err error
+		result, err = applyAtPath(result, pathSteps(parent.container), func(value interface{}) (interface{}, error) {
+			object, ok := value.(*orderedmap.OrderedMap)
+			if !ok {
+				return value, nil
+			}
+			child, found := object.Get(parent.key)
+			if !found {
+				return value, nil
+			}
+			if parent.typeKey != "" {
+				if rowType, ok := valueAtPath(object, pathSteps(parent.typeKey)); !ok || rowType == nil || fmt.Sprint(rowType) != parent.typeValue {
+					object.Delete(parent.key)
 				}
-			} else {
-				paths[i] = "$[]." + col
+				return object, nil
 			}
+			if childObject, ok := child.(*orderedmap.OrderedMap); child == nil || ok && isAllNull(childObject) {
+				object.Delete(parent.key)
+			}
+			return object, nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
+	return result, nil
+}
 
-	records, err := db.getAllRecords(rows, paths)
-	if err != nil {
-		return nil, err
+// valueAtPath returns the value at the (object) steps of a path in an object
+func valueAtPath(object *orderedmap.OrderedMap, steps []string) (interface{}, bool) {
+	var value interface{} = object
+	for _, step := range steps {
+		current, ok := value.(*orderedmap.OrderedMap)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = current.Get(step); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// combineRecordsIntoTree nests the records along their paths
+func (db *DB) combineRecordsIntoTree(records []*orderedmap.OrderedMap, paths []string, outer map[string]string) (interface{}, error) {
+	if len(records) == 0 {
+		return emptyResult(paths), nil
 	}
 
 	// Check if result should be an object (all paths start with "$." not "$[]")
@@ -512,7 +860,7 @@ func (db *DB) PathQuery(query string, arg interface{}) (interface{}, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("combineIntoTree returned nil tree")
 	}
-	result, err := db.removeHashes(tree, "$")
+	result, err := db.removeHashes(tree, "$", outer)
 	if err != nil {
 		return nil, err
 	}
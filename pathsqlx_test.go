@@ -1,11 +1,19 @@
 package pathsqlx
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/iancoleman/orderedmap"
 	_ "github.com/lib/pq"
 )
 
@@ -47,11 +55,15 @@ func setupTestDB(t *testing.T, cfg dbConfig) *DB {
 	// Drop tables if they exist
 	if cfg.driver == "mysql" {
 		db.Exec("SET FOREIGN_KEY_CHECKS=0")
+		db.Exec("DROP TABLE IF EXISTS post_tags")
+		db.Exec("DROP TABLE IF EXISTS tags")
 		db.Exec("DROP TABLE IF EXISTS comments")
 		db.Exec("DROP TABLE IF EXISTS posts")
 		db.Exec("DROP TABLE IF EXISTS categories")
 		db.Exec("SET FOREIGN_KEY_CHECKS=1")
 	} else {
+		db.Exec("DROP TABLE IF EXISTS post_tags CASCADE")
+		db.Exec("DROP TABLE IF EXISTS tags CASCADE")
 		db.Exec("DROP TABLE IF EXISTS comments CASCADE")
 		db.Exec("DROP TABLE IF EXISTS posts CASCADE")
 		db.Exec("DROP TABLE IF EXISTS categories CASCADE")
@@ -63,7 +75,9 @@ func setupTestDB(t *testing.T, cfg dbConfig) *DB {
 		schema = []string{
 			`CREATE TABLE categories (
 				id INT PRIMARY KEY AUTO_INCREMENT,
-				name VARCHAR(255) NOT NULL
+				parent_id INT,
+				name VARCHAR(255) NOT NULL,
+				FOREIGN KEY (parent_id) REFERENCES categories(id)
 			)`,
 			`CREATE TABLE posts (
 				id INT PRIMARY KEY AUTO_INCREMENT,
@@ -77,11 +91,24 @@ func setupTestDB(t *testing.T, cfg dbConfig) *DB {
 				message TEXT,
 				FOREIGN KEY (post_id) REFERENCES posts(id)
 			)`,
+			`CREATE TABLE tags (
+				id INT PRIMARY KEY AUTO_INCREMENT,
+				name VARCHAR(255) NOT NULL
+			)`,
+			`CREATE TABLE post_tags (
+				post_id INT,
+				tag_id INT,
+				sort_order INT,
+				PRIMARY KEY (post_id, tag_id),
+				FOREIGN KEY (post_id) REFERENCES posts(id),
+				FOREIGN KEY (tag_id) REFERENCES tags(id)
+			)`,
 		}
 	} else {
 		schema = []string{
 			`CREATE TABLE categories (
 				id SERIAL PRIMARY KEY,
+				parent_id INT REFERENCES categories(id),
 				name VARCHAR(255) NOT NULL
 			)`,
 			`CREATE TABLE posts (
@@ -94,6 +121,16 @@ func setupTestDB(t *testing.T, cfg dbConfig) *DB {
 				post_id INT REFERENCES posts(id),
 				message TEXT
 			)`,
+			`CREATE TABLE tags (
+				id SERIAL PRIMARY KEY,
+				name VARCHAR(255) NOT NULL
+			)`,
+			`CREATE TABLE post_tags (
+				post_id INT REFERENCES posts(id),
+				tag_id INT REFERENCES tags(id),
+				sort_order INT,
+				PRIMARY KEY (post_id, tag_id)
+			)`,
 		}
 	}
 
@@ -106,9 +143,11 @@ func setupTestDB(t *testing.T, cfg dbConfig) *DB {
 
 	// Insert test data
 	data := []string{
-		`INSERT INTO categories (id, name) VALUES (1, 'announcement'), (2, 'article')`,
+		`INSERT INTO categories (id, parent_id, name) VALUES (1, NULL, 'announcement'), (2, NULL, 'article'), (3, 1, 'release')`,
 		`INSERT INTO posts (id, category_id, content) VALUES (1, 1, 'blog started'), (2, 1, 'second post')`,
 		`INSERT INTO comments (id, post_id, message) VALUES (1, 1, 'great!'), (2, 1, 'nice!'), (3, 2, 'interesting'), (4, 2, 'cool')`,
+		`INSERT INTO tags (id, name) VALUES (1, 'news'), (2, 'blog')`,
+		`INSERT INTO post_tags (post_id, tag_id, sort_order) VALUES (1, 1, 1), (1, 2, 2), (2, 2, 1)`,
 	}
 	for _, d := range data {
 		_, err = db.Exec(d)
@@ -170,6 +209,19 @@ func TestPathQuery(t *testing.T) {
 			arg:   map[string]interface{}{},
 			want:  `[{"name":"announcement","post_count":2}]`,
 		},
+		{
+			name:  "category tree",
+			query: `SELECT id, parent_id, name FROM categories ORDER BY id -- TREE categories parent_id -> id`,
+			arg:   map[string]interface{}{},
+			want:  `[{"id":1,"parent_id":null,"name":"announcement","children":[{"id":3,"parent_id":1,"name":"release","children":[]}]},{"id":2,"parent_id":null,"name":"article","children":[]}]`,
+		},
+		{
+			name: "category tree with path and children key",
+			query: `SELECT c.id, c.name, c.parent_id FROM categories c ORDER BY c.id -- PATH c $.categories
+			-- TREE c parent_id -> id AS subcategories`,
+			arg:  map[string]interface{}{},
+			want: `{"categories":[{"id":1,"name":"announcement","parent_id":null,"subcategories":[{"id":3,"name":"release","parent_id":1,"subcategories":[]}]},{"id":2,"name":"article","parent_id":null,"subcategories":[]}]}`,
+		},
 		{
 			name:  "multiple scalar counts",
 			query: `SELECT (SELECT count(*) FROM posts) as posts, (SELECT count(*) FROM comments) as comments -- PATH $ $.statistics`,
@@ -182,6 +234,8 @@ func TestPathQuery(t *testing.T) {
 		t.Run(dbCfg.name, func(t *testing.T) {
 			db := setupTestDB(t, dbCfg)
 			defer func() {
+				db.Exec("DROP TABLE IF EXISTS post_tags")
+				db.Exec("DROP TABLE IF EXISTS tags")
 				db.Exec("DROP TABLE IF EXISTS comments")
 				db.Exec("DROP TABLE IF EXISTS posts")
 				db.Exec("DROP TABLE IF EXISTS categories")
@@ -387,12 +441,50 @@ func TestAutomaticPathInference(t *testing.T) {
 			arg:   map[string]interface{}{},
 			want:  `[{"p":{"id":1,"content":"blog started"},"cat":{"id":1,"name":"announcement"}}]`,
 		},
+		{
+			name:  "categories with posts with comments (nested one-to-many)",
+			query: `SELECT cat.id, cat.name, p.id, p.content, c.id, c.message FROM categories cat JOIN posts p ON p.category_id = cat.id JOIN comments c ON c.post_id = p.id WHERE cat.id = 1 ORDER BY p.id, c.id`,
+			arg:   map[string]interface{}{},
+			want:  `[{"cat":{"id":1,"name":"announcement"},"p":[{"id":1,"content":"blog started","c":[{"id":1,"message":"great!"},{"id":2,"message":"nice!"}]},{"id":2,"content":"second post","c":[{"id":3,"message":"interesting"},{"id":4,"message":"cool"}]}]}]`,
+		},
+		{
+			name:  "comments with post with category (nested many-to-one)",
+			query: `SELECT c.id, c.message, p.id, p.content, cat.id, cat.name FROM comments c JOIN posts p ON c.post_id = p.id JOIN categories cat ON p.category_id = cat.id WHERE c.id <= 2 ORDER BY c.id`,
+			arg:   map[string]interface{}{},
+			want:  `[{"c":{"id":1,"message":"great!"},"p":{"id":1,"content":"blog started","cat":{"id":1,"name":"announcement"}}},{"c":{"id":2,"message":"nice!"},"p":{"id":1,"content":"blog started","cat":{"id":1,"name":"announcement"}}}]`,
+		},
+		{
+			name:  "categories with parent (self-join)",
+			query: `SELECT c.id, c.name, parent.id, parent.name FROM categories c LEFT JOIN categories parent ON c.parent_id = parent.id ORDER BY c.id`,
+			arg:   map[string]interface{}{},
+			want:  `[{"c":{"id":1,"name":"announcement"},"parent":null},{"c":{"id":2,"name":"article"},"parent":null},{"c":{"id":3,"name":"release"},"parent":{"id":1,"name":"announcement"}}]`,
+		},
+		{
+			name:  "post with unaliased category named after FK column",
+			query: `SELECT p.id, categories.name FROM posts p JOIN categories ON p.category_id = categories.id WHERE p.id = 1`,
+			arg:   map[string]interface{}{},
+			want:  `[{"p":{"id":1},"category":{"name":"announcement"}}]`,
+		},
+		{
+			name:  "posts with tags (many-to-many through junction)",
+			query: `SELECT p.id, t.id, t.name FROM posts p JOIN post_tags pt ON pt.post_id = p.id JOIN tags t ON pt.tag_id = t.id ORDER BY p.id, t.id -- PATH p $.posts`,
+			arg:   map[string]interface{}{},
+			want:  `{"posts":[{"id":1,"t":[{"id":1,"name":"news"},{"id":2,"name":"blog"}]},{"id":2,"t":[{"id":2,"name":"blog"}]}]}`,
+		},
+		{
+			name:  "posts with their latest comment (per-parent limit)",
+			query: `SELECT p.id, c.id, c.message FROM posts p LEFT JOIN comments c ON c.post_id = p.id ORDER BY p.id -- LIMIT comments 1 ORDER BY comments.id DESC`,
+			arg:   map[string]interface{}{},
+			want:  `[{"p":{"id":1},"c":[{"id":2,"message":"nice!"}]},{"p":{"id":2},"c":[{"id":4,"message":"cool"}]}]`,
+		},
 	}
 
 	for _, dbCfg := range getTestDatabases() {
 		t.Run(dbCfg.name, func(t *testing.T) {
 			db := setupTestDB(t, dbCfg)
 			defer func() {
+				db.Exec("DROP TABLE IF EXISTS post_tags")
+				db.Exec("DROP TABLE IF EXISTS tags")
 				db.Exec("DROP TABLE IF EXISTS comments")
 				db.Exec("DROP TABLE IF EXISTS posts")
 				db.Exec("DROP TABLE IF EXISTS categories")
@@ -419,3 +511,1752 @@ func TestAutomaticPathInference(t *testing.T) {
 		})
 	}
 }
+
+// staticMetadataReader serves fixed metadata so path inference can be tested without a database
+type staticMetadataReader struct {
+	tables      map[string]*TableMetadata
+	foreignKeys []ForeignKey
+	exact       bool // names are matched exactly, like PostgreSQL does
+}
+
+func newStaticMetadataReader() *staticMetadataReader {
+	return &staticMetadataReader{
+		tables: map[string]*TableMetadata{
+			"categories":    {Name: "categories", Columns: []string{"id", "parent_id", "name"}, PrimaryKeys: []string{"id"}},
+			"posts":         {Name: "posts", Columns: []string{"id", "category_id", "content"}, PrimaryKeys: []string{"id"}},
+			"comments":      {Name: "comments", Columns: []string{"id", "post_id", "message"}, PrimaryKeys: []string{"id"}},
+			"comment_likes": {Name: "comment_likes", Columns: []string{"id", "comment_id", "user_name"}, PrimaryKeys: []string{"id"}},
+			"tags":          {Name: "tags", Columns: []string{"id", "name"}, PrimaryKeys: []string{"id"}},
+			"post_tags":     {Name: "post_tags", Columns: []string{"post_id", "tag_id", "sort_order"}, PrimaryKeys: []string{"post_id", "tag_id"}},
+			"users":         {Name: "users", Columns: []string{"id", "name"}, PrimaryKeys: []string{"id"}},
+			"messages":      {Name: "messages", Columns: []string{"id", "sender_id", "recipient_id", "body"}, PrimaryKeys: []string{"id"}},
+			"photos":        {Name: "photos", Columns: []string{"id", "url"}, PrimaryKeys: []string{"id"}},
+			"likes":         {Name: "likes", Columns: []string{"id", "likeable_type", "likeable_id"}, PrimaryKeys: []string{"id"}},
+			"authors":       {Name: "authors", Columns: []string{"author_id", "name"}, PrimaryKeys: []string{"author_id"}},
+			"books":         {Name: "books", Columns: []string{"book_id", "author_id", "title"}, PrimaryKeys: []string{"book_id"}},
+			"reviews":       {Name: "reviews", Columns: []string{"review_id", "book_id", "stars"}, PrimaryKeys: []string{"review_id"}},
+			"editions":      {Name: "editions", Columns: []string{"book_id", "edition_no", "year"}, PrimaryKeys: []string{"book_id", "edition_no"}},
+			"printings":     {Name: "printings", Columns: []string{"id", "book_id", "edition_no", "copies"}, PrimaryKeys: []string{"id"}},
+		},
+		foreignKeys: []ForeignKey{
+			{FromTable: "categories", ToTable: "categories", Columns: []ColumnPair{{From: "parent_id", To: "id"}}},
+			{FromTable: "posts", ToTable: "categories", Columns: []ColumnPair{{From: "category_id", To: "id"}}},
+			{FromTable: "comments", ToTable: "posts", Columns: []ColumnPair{{From: "post_id", To: "id"}}},
+			{FromTable: "comment_likes", ToTable: "comments", Columns: []ColumnPair{{From: "comment_id", To: "id"}}},
+			{FromTable: "post_tags", ToTable: "posts", Columns: []ColumnPair{{From: "post_id", To: "id"}}},
+			{FromTable: "post_tags", ToTable: "tags", Columns: []ColumnPair{{From: "tag_id", To: "id"}}},
+			{FromTable: "messages", ToTable: "users", Columns: []ColumnPair{{From: "sender_id", To: "id"}}},
+			{FromTable: "messages", ToTable: "users", Columns: []ColumnPair{{From: "recipient_id", To: "id"}}},
+			{FromTable: "books", ToTable: "authors", Columns: []ColumnPair{{From: "author_id", To: "author_id"}}},
+			{FromTable: "reviews", ToTable: "books", Columns: []ColumnPair{{From: "book_id", To: "book_id"}}},
+			{FromTable: "editions", ToTable: "books", Columns: []ColumnPair{{From: "book_id", To: "book_id"}}},
+			{FromTable: "printings", ToTable: "editions", Columns: []ColumnPair{{From: "book_id", To: "book_id"}, {From: "edition_no", To: "edition_no"}}},
+		},
+	}
+}
+
+func (r *staticMetadataReader) GetTableMetadata(tableName string) (*TableMetadata, error) {
+	metadata, ok := r.tables[tableName]
+	if !ok && !r.exact {
+		// Like MySQL, names that are not in the catalog are folded to lower case
+		metadata, ok = r.tables[strings.ToLower(tableName)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown table: %s", tableName)
+	}
+	metadata.ForeignKeys, _ = r.GetForeignKeys(qualifiedTableName(metadata.Schema, metadata.Name))
+	return metadata, nil
+}
+
+func (r *staticMetadataReader) GetForeignKeys(tableName string) ([]ForeignKey, error) {
+	result := []ForeignKey{}
+	for _, fk := range r.foreignKeys {
+		if qualifiedTableName(fk.FromSchema, fk.FromTable) == tableName {
+			result = append(result, fk)
+		}
+	}
+	return result, nil
+}
+
+func (r *staticMetadataReader) GetAllForeignKeys() ([]ForeignKey, error) {
+	return r.foreignKeys, nil
+}
+
+func (r *staticMetadataReader) InvalidateCache() {}
+
+func TestInferPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		columns   []string
+		relations []PolymorphicRelation
+		want      map[string]string
+	}{
+		{
+			name:    "posts with comments and likes nested along the join tree",
+			query:   `SELECT p.id, c.id, l.id FROM posts p JOIN comments c ON c.post_id = p.id JOIN comment_likes l ON l.comment_id = c.id`,
+			columns: []string{"p.id", "c.id", "l.id"},
+			want: map[string]string{
+				"p.id": "$[].p.id",
+				"c.id": "$[].c[].id",
+				"l.id": "$[].c[].l[].id",
+			},
+		},
+		{
+			name:    "categories with posts and comments under a root hint",
+			query:   `SELECT cat.id, p.id, c.id FROM categories cat JOIN posts p ON p.category_id = cat.id JOIN comments c ON c.post_id = p.id -- PATH cat $.categories`,
+			columns: []string{"cat.id", "p.id", "c.id"},
+			want: map[string]string{
+				"cat.id": "$.categories[].id",
+				"p.id":   "$.categories[].p[].id",
+				"c.id":   "$.categories[].p[].c[].id",
+			},
+		},
+		{
+			name:    "comments with post and category nested as objects",
+			query:   `SELECT c.id, p.id, cat.id FROM comments c JOIN posts p ON c.post_id = p.id JOIN categories cat ON p.category_id = cat.id`,
+			columns: []string{"c.id", "p.id", "cat.id"},
+			want: map[string]string{
+				"c.id":   "$[].c.id",
+				"p.id":   "$[].p.id",
+				"cat.id": "$[].p.cat.id",
+			},
+		},
+		{
+			name:    "posts with tags through a junction table",
+			query:   `SELECT p.id, t.id, t.name FROM posts p JOIN post_tags pt ON pt.post_id = p.id JOIN tags t ON pt.tag_id = t.id -- PATH p $.posts`,
+			columns: []string{"p.id", "t.id", "t.name"},
+			want: map[string]string{
+				"p.id":   "$.posts[].id",
+				"t.id":   "$.posts[].t[].id",
+				"t.name": "$.posts[].t[].name",
+			},
+		},
+		{
+			name:    "junction table with selected key columns",
+			query:   `SELECT p.id, pt.tag_id, t.name FROM posts p JOIN post_tags pt ON pt.post_id = p.id JOIN tags t ON pt.tag_id = t.id`,
+			columns: []string{"p.id", "pt.tag_id", "t.name"},
+			want: map[string]string{
+				"p.id":      "$[].p.id",
+				"pt.tag_id": "$[].t[].tag_id",
+				"t.name":    "$[].t[].name",
+			},
+		},
+		{
+			name:    "junction table with payload columns",
+			query:   `SELECT p.id, pt.sort_order, t.name FROM posts p JOIN post_tags pt ON pt.post_id = p.id JOIN tags t ON pt.tag_id = t.id`,
+			columns: []string{"p.id", "pt.sort_order", "t.name"},
+			want: map[string]string{
+				"p.id":          "$[].p.id",
+				"pt.sort_order": "$[].pt[].sort_order",
+				"t.name":        "$[].pt[].t.name",
+			},
+		},
+		{
+			name:    "self-join to the parent category",
+			query:   `SELECT c.id, parent.id FROM categories c LEFT JOIN categories parent ON c.parent_id = parent.id`,
+			columns: []string{"c.id", "parent.id"},
+			want: map[string]string{
+				"c.id":      "$[].c.id",
+				"parent.id": "$[].parent.id",
+			},
+		},
+		{
+			name:    "self-join to the child categories",
+			query:   `SELECT c.id, sub.id FROM categories c LEFT JOIN categories sub ON c.id = sub.parent_id`,
+			columns: []string{"c.id", "sub.id"},
+			want: map[string]string{
+				"c.id":   "$[].c.id",
+				"sub.id": "$[].sub[].id",
+			},
+		},
+		{
+			name:    "multiple FKs to the same table named after the FK column",
+			query:   `SELECT m.id, users.name, r.name FROM messages m JOIN users ON m.sender_id = users.id JOIN users r ON r.id = m.recipient_id`,
+			columns: []string{"m.id", "users.name", "r.name"},
+			want: map[string]string{
+				"m.id":       "$[].m.id",
+				"users.name": "$[].sender.name",
+				"r.name":     "$[].r.name",
+			},
+		},
+		{
+			name:    "polymorphic parents declared by a hint",
+			query:   `SELECT l.id, p.id, ph.id FROM likes l LEFT JOIN posts p ON l.likeable_type = 'post' AND l.likeable_id = p.id LEFT JOIN photos ph ON l.likeable_type = 'photo' AND l.likeable_id = ph.id -- POLYMORPHIC l likeable_type likeable_id`,
+			columns: []string{"l.id", "p.id", "ph.id"},
+			want: map[string]string{
+				"l.id":  "$[].l.id",
+				"p.id":  "$[].p.id",
+				"ph.id": "$[].ph.id",
+			},
+		},
+		{
+			name:      "polymorphic children declared by the API",
+			query:     `SELECT p.id, l.id FROM posts p JOIN likes l ON l.likeable_id = p.id AND l.likeable_type = 'post'`,
+			columns:   []string{"p.id", "l.id"},
+			relations: []PolymorphicRelation{{Table: "likes", TypeColumn: "likeable_type", IDColumn: "likeable_id"}},
+			want: map[string]string{
+				"p.id": "$[].p.id",
+				"l.id": "$[].l[].id",
+			},
+		},
+		{
+			name:    "comma join from WHERE condition",
+			query:   `SELECT posts.id, comments.id FROM posts, comments WHERE comments.post_id = posts.id AND posts.id = 1 -- PATH posts $.posts`,
+			columns: []string{"posts.id", "comments.id"},
+			want: map[string]string{
+				"posts.id":    "$.posts[].id",
+				"comments.id": "$.posts[].comments[].id",
+			},
+		},
+		{
+			name:    "comma joins in FROM order",
+			query:   `SELECT c.id, p.id, cat.name FROM comments c, posts p, categories cat WHERE p.category_id = cat.id AND c.post_id = p.id`,
+			columns: []string{"c.id", "p.id", "cat.name"},
+			want: map[string]string{
+				"c.id":     "$[].c.id",
+				"p.id":     "$[].p.id",
+				"cat.name": "$[].p.cat.name",
+			},
+		},
+		{
+			name:    "join with USING",
+			query:   `SELECT a.name, b.title FROM authors a JOIN books b USING (author_id)`,
+			columns: []string{"a.name", "b.title"},
+			want: map[string]string{
+				"a.name":  "$[].a.name",
+				"b.title": "$[].b[].title",
+			},
+		},
+		{
+			name:    "USING column of an earlier table",
+			query:   `SELECT b.title, a.name, r.stars FROM books b JOIN authors a USING (author_id) LEFT JOIN reviews r USING (book_id)`,
+			columns: []string{"b.title", "a.name", "r.stars"},
+			want: map[string]string{
+				"b.title": "$[].b.title",
+				"a.name":  "$[].a.name",
+				"r.stars": "$[].r[].stars",
+			},
+		},
+		{
+			name:    "natural join",
+			query:   `SELECT a.name, b.title FROM authors a NATURAL JOIN books b`,
+			columns: []string{"a.name", "b.title"},
+			want: map[string]string{
+				"a.name":  "$[].a.name",
+				"b.title": "$[].b[].title",
+			},
+		},
+		{
+			name:    "composite foreign key",
+			query:   `SELECT e.year, pr.copies FROM editions e JOIN printings pr ON pr.book_id = e.book_id AND pr.edition_no = e.edition_no`,
+			columns: []string{"e.year", "pr.copies"},
+			want: map[string]string{
+				"e.year":    "$[].e.year",
+				"pr.copies": "$[].pr[].copies",
+			},
+		},
+		{
+			name:    "composite foreign key partially joined",
+			query:   `SELECT e.year, pr.copies FROM editions e JOIN printings pr ON pr.book_id = e.book_id`,
+			columns: []string{"e.year", "pr.copies"},
+			want: map[string]string{
+				"e.year":    "$[].e.year",
+				"pr.copies": "$[].pr.copies",
+			},
+		},
+		{
+			name:    "root directive reverses the join",
+			query:   `SELECT c.id, p.id, cat.name FROM comments c JOIN posts p ON c.post_id = p.id JOIN categories cat ON p.category_id = cat.id -- ROOT posts`,
+			columns: []string{"c.id", "p.id", "cat.name"},
+			want: map[string]string{
+				"p.id":     "$[].p.id",
+				"c.id":     "$[].c[].id",
+				"cat.name": "$[].cat.name",
+			},
+		},
+		{
+			name:    "right join re-roots on the preserved side",
+			query:   `SELECT p.id, c.id FROM posts p RIGHT JOIN comments c ON c.post_id = p.id`,
+			columns: []string{"p.id", "c.id"},
+			want: map[string]string{
+				"c.id": "$[].c.id",
+				"p.id": "$[].p.id",
+			},
+		},
+		{
+			name:    "cte with lineage to a table",
+			query:   `WITH recent AS (SELECT id, post_id AS parent, message FROM comments WHERE id > 10) SELECT p.id, r.message FROM posts p LEFT JOIN recent r ON r.parent = p.id`,
+			columns: []string{"p.id", "r.message"},
+			want: map[string]string{
+				"p.id":      "$[].p.id",
+				"r.message": "$[].r[].message",
+			},
+		},
+		{
+			name:    "cte as many-to-one parent",
+			query:   `WITH p AS (SELECT id, content FROM posts), c AS (SELECT * FROM comments) SELECT c.id, p.content FROM c JOIN p ON c.post_id = p.id`,
+			columns: []string{"c.id", "p.content"},
+			want: map[string]string{
+				"c.id":      "$[].c.id",
+				"p.content": "$[].post.content",
+			},
+		},
+		{
+			name: "recursive cte",
+			query: `WITH RECURSIVE tree (id, parent, name) AS (
+				SELECT id, parent_id, name FROM categories WHERE parent_id IS NULL
+				UNION ALL
+				SELECT c.id, c.parent_id, c.name FROM categories c JOIN tree t ON c.parent_id = t.id
+			) SELECT p.id, t.name FROM tree t JOIN posts p ON p.category_id = t.id`,
+			columns: []string{"p.id", "t.name"},
+			want: map[string]string{
+				"t.name": "$[].t.name",
+				"p.id":   "$[].p[].id",
+			},
+		},
+		{
+			name:    "derived table with lineage to a table",
+			query:   `SELECT p.id, c.text FROM posts p JOIN (SELECT id, post_id, message AS text FROM comments) c ON c.post_id = p.id`,
+			columns: []string{"p.id", "c.text"},
+			want: map[string]string{
+				"p.id":   "$[].p.id",
+				"c.text": "$[].c[].text",
+			},
+		},
+		{
+			name:    "nested derived tables as many-to-one parent",
+			query:   `SELECT c.id, x.content FROM comments c JOIN (SELECT * FROM (SELECT id AS post, content FROM posts) y) x ON c.post_id = x.post`,
+			columns: []string{"c.id", "x.content"},
+			want: map[string]string{
+				"c.id":      "$[].c.id",
+				"x.content": "$[].x.content",
+			},
+		},
+		{
+			name:    "junction table kept by a hint",
+			query:   `SELECT p.id, t.name FROM posts p JOIN post_tags pt ON pt.post_id = p.id JOIN tags t ON pt.tag_id = t.id -- PATH pt $[].tagging`,
+			columns: []string{"p.id", "t.name"},
+			want: map[string]string{
+				"p.id":   "$[].p.id",
+				"t.name": "$[].tagging[].t.name",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			engine := NewPathInferenceEngine(newStaticMetadataReader())
+			for _, relation := range tt.relations {
+				engine.AddPolymorphicRelation(relation)
+			}
+			got, err := engine.InferPaths(analysis, tt.columns)
+			if err != nil {
+				t.Fatalf("InferPaths() error = %v", err)
+			}
+			for column, want := range tt.want {
+				if got[column] != want {
+					t.Errorf("InferPaths()[%s] = %s, want %s", column, got[column], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRootAlias(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`SELECT * FROM posts p, comments c, categories cat WHERE c.post_id = p.id AND p.category_id = cat.id`, "p"},
+		{`SELECT * FROM comments c, posts p WHERE c.post_id = p.id`, "c"},
+		{`SELECT * FROM comments c JOIN posts p ON c.post_id = p.id`, "c"},
+		{`SELECT * FROM comments c JOIN posts p ON c.post_id = p.id -- ROOT p`, "p"},
+		{`SELECT * FROM posts p RIGHT JOIN comments c ON c.post_id = p.id`, "c"},
+		{`SELECT * FROM posts p FULL OUTER JOIN comments c ON c.post_id = p.id`, "p"},
+	}
+
+	for _, tt := range tests {
+		// Map iteration order is random, so analyze the query repeatedly
+		for i := 0; i < 20; i++ {
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			if got := analysis.RootAlias(); got != tt.want {
+				t.Fatalf("RootAlias() of %s = %s, want %s", tt.query, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []SelectColumn
+	}{
+		{
+			name:  "columns and aliases",
+			query: `SELECT p.id, c.message AS text, title FROM posts p JOIN comments c ON c.post_id = p.id`,
+			want: []SelectColumn{
+				{Name: "id", Alias: "p", Column: "id"},
+				{Name: "text", Alias: "c", Column: "message"},
+				{Name: "title", Column: "title"},
+			},
+		},
+		{
+			name:  "distinct, literals and subqueries",
+			query: "SELECT DISTINCT p.id, 'a, b' AS label, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS `count` FROM posts p",
+			want: []SelectColumn{
+				{Name: "id", Alias: "p", Column: "id"},
+				{Name: "label", Expr: "'a, b'"},
+				{Name: "count", Expr: "(select COUNT(*) from comments as c where c.post_id = p.id)"},
+			},
+		},
+		{
+			name: "comments and stars",
+			query: `SELECT p.*, -- the post
+				c.id FROM posts p JOIN comments c ON c.post_id = p.id`,
+			want: []SelectColumn{
+				{Alias: "p", Star: true},
+				{Name: "id", Alias: "c", Column: "id"},
+			},
+		},
+		{
+			name:  "regex fallback",
+			query: `SELECT p.id, COUNT(c.id) AS total, t.* FROM posts p FULL OUTER JOIN comments c ON c.post_id = p.id, tags t`,
+			want: []SelectColumn{
+				{Name: "id", Alias: "p", Column: "id"},
+				{Name: "total", Expr: "COUNT(c.id)"},
+				{Alias: "t", Star: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			if got, want := fmt.Sprintf("%+v", analysis.Columns), fmt.Sprintf("%+v", tt.want); got != want {
+				t.Errorf("Columns = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestExpandStars(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "qualified stars",
+			query: `SELECT p.*, c.* FROM posts p JOIN comments c ON c.post_id = p.id`,
+			want:  []string{"p.id", "p.category_id", "p.content", "c.id", "c.post_id", "c.message"},
+		},
+		{
+			name:  "star of all tables",
+			query: `SELECT *, c.id AS comment FROM comments c JOIN posts p ON c.post_id = p.id`,
+			want:  []string{"c.id", "c.post_id", "c.message", "p.id", "p.category_id", "p.content", "c.comment"},
+		},
+		{
+			name:  "star of a using join is kept",
+			query: `SELECT p.id, * FROM posts p JOIN comments c USING (id)`,
+			want:  []string{"p.id", "*"},
+		},
+		{
+			name:  "star of a subquery",
+			query: `SELECT s.*, p.id FROM (SELECT 1 AS id) s JOIN posts p ON p.id = s.id`,
+			want:  []string{"s.id", "p.id"},
+		},
+		{
+			name:  "star of an unknown table is kept",
+			query: `SELECT x.*, p.id FROM unknown x JOIN posts p ON p.id = x.id`,
+			want:  []string{"x.*", "p.id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			analysis.ExpandStars(newStaticMetadataReader())
+			got := []string{}
+			for _, column := range analysis.Columns {
+				switch {
+				case column.Star && column.Alias != "":
+					got = append(got, column.Alias+".*")
+				case column.Star:
+					got = append(got, "*")
+				default:
+					got = append(got, column.Source(column.Name, analysis))
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ExpandStars() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDerivedMetadata(t *testing.T) {
+	query := `WITH RECURSIVE c (id, parent) AS (SELECT id, post_id FROM comments), p AS (SELECT * FROM posts), x AS (SELECT 1 AS id)
+		SELECT * FROM p JOIN c ON c.parent = p.id, x`
+	analysis, err := AnalyzeQuery(query)
+	if err != nil {
+		t.Fatalf("AnalyzeQuery() error = %v", err)
+	}
+	if got := fmt.Sprint(analysis.OrderedAliases()); got != "[p c x]" {
+		t.Fatalf("OrderedAliases() = %s, want [p c x]", got)
+	}
+	metadata := analysis.metadataReader(newStaticMetadataReader())
+
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{"c", "[id parent] [id] [c->posts parent->id c->p parent->id]"},
+		{"p", "[id category_id content] [id] [p->categories category_id->id]"},
+		{"x", "[id] [] []"},
+	}
+	for _, tt := range tests {
+		table, err := metadata.GetTableMetadata(tt.table)
+		if err != nil {
+			t.Fatalf("GetTableMetadata(%s) error = %v", tt.table, err)
+		}
+		fks := []string{}
+		for _, fk := range table.ForeignKeys {
+			for _, pair := range fk.Columns {
+				fks = append(fks, fk.FromTable+"->"+fk.ToTable, pair.From+"->"+pair.To)
+			}
+		}
+		if got := fmt.Sprint(table.Columns, table.PrimaryKeys, fks); got != tt.want {
+			t.Errorf("GetTableMetadata(%s) = %s, want %s", tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestCTENames(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "mysql names are case-insensitive",
+			dialect: MySQL,
+			query:   "WITH Recent (Id, `Post``Id`) AS (SELECT id, post_id FROM comments) SELECT r.id FROM recent r",
+			want:    "Recent [Id Post`Id] map[r:Recent]",
+		},
+		{
+			name:    "quoted postgres name",
+			dialect: Postgres,
+			query:   `WITH "Recent" ("Id", Post_Id) AS (SELECT id, post_id FROM comments) SELECT r.id FROM recent r`,
+			want:    "Recent [Id post_id] map[r:recent]",
+		},
+		{
+			name:    "unquoted postgres name",
+			dialect: Postgres,
+			query:   `WITH Recent AS (SELECT id, post_id FROM comments) SELECT r.id FROM "recent" r`,
+			want:    "recent [id post_id] map[r:recent]",
+		},
+		{
+			name:    "doubled quotes",
+			dialect: Postgres,
+			query:   `WITH "a""b" AS (SELECT id FROM comments) SELECT r.id FROM "a""b" r`,
+			want:    `a"b [id] map[r:a"b]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQueryDialect(tt.query, tt.dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+			}
+			got := []string{}
+			for name, derived := range analysis.Derived {
+				got = append(got, name+" "+fmt.Sprint(derived.Columns))
+			}
+			if fmt.Sprint(strings.Join(got, ", "), " ", analysis.Tables) != tt.want {
+				t.Errorf("AnalyzeQueryDialect() = %s %v, want %s", strings.Join(got, ", "), analysis.Tables, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnionBranches(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		query    string
+		paths    []string
+		rewrite  string
+		branches int
+	}{
+		{
+			name:     "branches under different keys",
+			dialect:  MySQL,
+			query:    "SELECT p.id, p.content FROM posts p -- PATH p $.posts[]\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.comments[]",
+			paths:    []string{"$.posts[].id,$.posts[].content", "$.comments[].id,$.comments[].content"},
+			rewrite:  "select p.id, p.content, 0 as pathsqlx_branch from posts as p union all select c.id, c.message, 1 as pathsqlx_branch from comments as c",
+			branches: 2,
+		},
+		{
+			name:     "branches merged into one array",
+			dialect:  MySQL,
+			query:    "(SELECT id, content FROM posts WHERE content LIKE '%union%') UNION SELECT id, message FROM comments ORDER BY id",
+			paths:    []string{"$[].id,$[].content", "$[].id,$[].content"},
+			branches: 2,
+		},
+		{
+			name:     "union in a subquery",
+			dialect:  MySQL,
+			query:    "SELECT p.id FROM posts p WHERE p.id IN (SELECT post_id FROM comments UNION SELECT post_id FROM post_tags)",
+			branches: 0,
+		},
+		{
+			name:     "postgres branches under different keys",
+			dialect:  Postgres,
+			query:    "SELECT p.id, p.\"content\" FROM posts p -- PATH p $.posts[]\nUNION ALL\nSELECT c.id, c.message FROM comments c WHERE c.message ILIKE 'it''s%' -- PATH c $.comments[]",
+			paths:    []string{"$.posts[].id,$.posts[].content", "$.comments[].id,$.comments[].content"},
+			rewrite:  "select p.id, p.\"content\", 0 as pathsqlx_branch from posts as p union all select c.id, c.message, 1 as pathsqlx_branch from comments as c where c.message ilike 'it''s%'",
+			branches: 2,
+		},
+		{
+			name:     "branches in the dialect of the query",
+			dialect:  Postgres,
+			query:    "SELECT p.id, p.content FROM posts p WHERE p.id # 1 = 0 -- PATH p $.items[]\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.items[]",
+			paths:    []string{"$.items[].id,$.items[].content", "$.items[].id,$.items[].content"},
+			branches: 2,
+		},
+	}
+
+	db := &DB{metadataReader: newStaticMetadataReader()}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQueryDialect(tt.query, tt.dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+			}
+			if len(analysis.Branches) != tt.branches {
+				t.Fatalf("AnalyzeQuery() has %d branches, want %d", len(analysis.Branches), tt.branches)
+			}
+			if tt.branches == 0 {
+				return
+			}
+			for i, branch := range analysis.Branches {
+				_, paths, err := db.columnPaths(branch, []string{"id", "content"})
+				if err != nil {
+					t.Fatalf("columnPaths() error = %v", err)
+				}
+				if got := strings.Join(paths, ","); got != tt.paths[i] {
+					t.Errorf("branch %d paths = %s, want %s", i, got, tt.paths[i])
+				}
+			}
+			if got := db.hasBranchPaths(analysis); got != (tt.rewrite != "") {
+				t.Fatalf("hasBranchPaths() = %v, want %v", got, tt.rewrite != "")
+			}
+			if tt.rewrite != "" {
+				if got, err := addUnionBranchColumn(tt.query, len(analysis.Branches), tt.dialect); err != nil || got != tt.rewrite {
+					t.Errorf("addUnionBranchColumn() = %s, %v, want %s", got, err, tt.rewrite)
+				}
+			}
+		})
+	}
+
+	// Branches with different paths that can't be told apart are an error, not rows at
+	// the paths of the first branch
+	query := "SELECT p.id, p.content FROM posts p WHERE p.id # 1 = 0 -- PATH p $.posts[]\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.comments[]"
+	analysis, err := AnalyzeQueryDialect(query, Postgres)
+	if err != nil {
+		t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+	}
+	if _, err := db.pathQuery(query, analysis, map[string]interface{}{}); err == nil {
+		t.Errorf("pathQuery() with branches that can't be told apart should return error")
+	}
+}
+
+// rowsDriver is a database driver that returns the same rows for every query
+type rowsDriver struct {
+	columns []string
+	rows    [][]driver.Value
+	queries []string               // the queries it prepared
+	results map[string]*rowsDriver // rows of the queries that contain the key instead
+}
+
+type rowsConn struct{ *rowsDriver }
+
+type rowsStmt struct {
+	*rowsDriver
+	query string
+}
+
+type rowsResult struct {
+	*rowsDriver
+	next int
+}
+
+var testRows = &rowsDriver{}
+
+func init() {
+	sql.Register("pathsqlx_rows", testRows)
+}
+
+func (d *rowsDriver) Open(string) (driver.Conn, error) { return rowsConn{d}, nil }
+func (c rowsConn) Close() error                        { return nil }
+func (c rowsConn) Begin() (driver.Tx, error)           { return nil, fmt.Errorf("not supported") }
+func (s rowsStmt) Close() error                        { return nil }
+func (s rowsStmt) NumInput() int                       { return -1 }
+func (c rowsConn) Prepare(query string) (driver.Stmt, error) {
+	c.queries = append(c.queries, query)
+	return rowsStmt{c.rowsDriver, query}, nil
+}
+func (s rowsStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s rowsStmt) Query([]driver.Value) (driver.Rows, error) {
+	for key, result := range s.results {
+		if strings.Contains(s.query, key) {
+			return &rowsResult{rowsDriver: result}, nil
+		}
+	}
+	return &rowsResult{rowsDriver: s.rowsDriver}, nil
+}
+func (r *rowsResult) Columns() []string { return r.columns }
+func (r *rowsResult) Close() error      { return nil }
+func (r *rowsResult) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func TestUnionRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		columns []string
+		rows    [][]driver.Value
+		want    string
+	}{
+		{
+			name:    "rows at the paths of their branch",
+			query:   "SELECT p.id, p.content FROM posts p -- PATH p $.posts[]\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.comments[]",
+			columns: []string{"id", "content", "pathsqlx_branch"},
+			rows:    [][]driver.Value{{int64(1), "a", int64(0)}, {int64(10), "x", int64(1)}, {int64(2), "b", int64(0)}, {int64(11), "y", int64(1)}},
+			want:    `{"posts":[{"id":1,"content":"a"},{"id":2,"content":"b"}],"comments":[{"id":10,"content":"x"},{"id":11,"content":"y"}]}`,
+		},
+		{
+			name:    "limit on the alias of a later branch",
+			query:   "SELECT p.id, p.content FROM posts p -- PATH p $.posts[]\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.comments[]\n-- LIMIT c 1 ORDER BY c.id DESC",
+			columns: []string{"id", "content", "pathsqlx_branch"},
+			rows:    [][]driver.Value{{int64(1), "a", int64(0)}, {int64(10), "x", int64(1)}, {int64(11), "y", int64(1)}},
+			want:    `{"posts":[{"id":1,"content":"a"}],"comments":[{"id":11,"content":"y"}]}`,
+		},
+		{
+			name:    "limit on a table name of a later branch",
+			query:   "SELECT p.id, p.content FROM posts p -- PATH p $.posts[]\n-- LIMIT comments 1 ORDER BY comments.id\nUNION ALL\nSELECT c.id, c.message FROM comments c -- PATH c $.comments[]",
+			columns: []string{"id", "content", "pathsqlx_branch"},
+			rows:    [][]driver.Value{{int64(1), "a", int64(0)}, {int64(11), "y", int64(1)}, {int64(10), "x", int64(1)}},
+			want:    `{"posts":[{"id":1,"content":"a"}],"comments":[{"id":10,"content":"x"}]}`,
+		},
+	}
+
+	db := MustOpen("pathsqlx_rows", "")
+	db.metadataReader = newStaticMetadataReader()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRows.columns, testRows.rows = tt.columns, tt.rows
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			result, err := db.runUnionQuery(tt.query, analysis, map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("runUnionQuery() error = %v", err)
+			}
+			if got, _ := json.Marshal(result); string(got) != tt.want {
+				t.Errorf("runUnionQuery() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolymorphicParents(t *testing.T) {
+	joins := ` FROM likes l LEFT JOIN posts p ON l.likeable_type = 'post' AND l.likeable_id = p.id LEFT JOIN photos ph ON l.likeable_type = 'photo' AND l.likeable_id = ph.id -- POLYMORPHIC l likeable_type likeable_id`
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		columns []string
+		rows    [][]driver.Value
+		want    string
+	}{
+		{
+			name:    "parent selected by the type column",
+			dialect: MySQL,
+			query:   `SELECT l.id, l.likeable_type, p.id, ph.id` + joins,
+			columns: []string{"id", "likeable_type", "id", "id"},
+			rows:    [][]driver.Value{{int64(1), "post", int64(1), nil}, {int64(2), "photo", nil, int64(3)}, {int64(3), "post", nil, nil}},
+			want:    `[{"l":{"id":1,"likeable_type":"post"},"p":{"id":1}},{"l":{"id":2,"likeable_type":"photo"},"ph":{"id":3}},{"l":{"id":3,"likeable_type":"post"},"p":null}]`,
+		},
+		{
+			name:    "parent without values without a type column",
+			dialect: MySQL,
+			query:   `SELECT l.id, p.id, ph.id` + joins,
+			columns: []string{"id", "id", "id"},
+			rows:    [][]driver.Value{{int64(1), int64(1), nil}, {int64(2), nil, int64(3)}},
+			want:    `[{"l":{"id":1},"p":{"id":1}},{"l":{"id":2},"ph":{"id":3}}]`,
+		},
+		{
+			name:    "postgres quoted names",
+			dialect: Postgres,
+			query:   `SELECT l.id, l."likeable_type", p.id, ph.id FROM likes l LEFT JOIN posts p ON "l"."likeable_type" = 'Post' AND l.likeable_id = p.id LEFT JOIN photos ph ON 'Photo' = l."likeable_type" AND l.likeable_id = ph.id -- POLYMORPHIC l "likeable_type" likeable_id`,
+			columns: []string{"id", "likeable_type", "id", "id"},
+			rows:    [][]driver.Value{{int64(1), "Post", int64(1), nil}, {int64(2), "Photo", nil, int64(3)}},
+			want:    `[{"l":{"id":1,"likeable_type":"Post"},"p":{"id":1}},{"l":{"id":2,"likeable_type":"Photo"},"ph":{"id":3}}]`,
+		},
+	}
+
+	sqlDB, err := sql.Open("pathsqlx_rows", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	dbs := map[Dialect]*DB{MySQL: MustOpen("pathsqlx_rows", ""), Postgres: NewDb(sqlDB, "postgres")}
+	for _, db := range dbs {
+		db.metadataReader = newStaticMetadataReader()
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRows.columns, testRows.rows = tt.columns, tt.rows
+			result, err := dbs[tt.dialect].PathQuery(tt.query, map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("PathQuery() error = %v", err)
+			}
+			if got, _ := json.Marshal(result); string(got) != tt.want {
+				t.Errorf("PathQuery() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The names in the join condition may be quoted in the style of either dialect
+	relation := &PolymorphicRelation{Table: "likes", TypeColumn: "likeable_type", IDColumn: "likeable_id"}
+	for _, condition := range []string{"l.likeable_type = 'post'", "`l`.`likeable_type` = 'post'", `"l"."likeable_type" = 'post'`} {
+		if got, ok := polymorphicType(JoinInfo{LeftAlias: "l", Condition: condition}, relation); !ok || got != "post" {
+			t.Errorf("polymorphicType(%s) = %s, %v, want post", condition, got, ok)
+		}
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	sqlDB, err := sql.Open("pathsqlx_rows", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	reader := NewMetadataReader(sqlDB, "postgres").(*metadataReaderImpl)
+	ctx := context.Background()
+
+	// The search_path is read once per connection, the names are resolved in its order
+	tests := []struct {
+		schemas []string
+		want    string
+	}{
+		{[]string{"tenant", "public"}, "tenant.posts tenant.comments tenant.posts"},
+		{[]string{"public"}, "public.posts public.comments public.posts"},
+	}
+	for _, tt := range tests {
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			t.Fatalf("Conn() error = %v", err)
+		}
+		testRows.columns, testRows.rows, testRows.queries = []string{"s"}, [][]driver.Value{}, nil
+		for _, schema := range tt.schemas {
+			testRows.rows = append(testRows.rows, []driver.Value{schema})
+		}
+		connReader, err := reader.forConnection(ctx, conn)
+		if err != nil {
+			t.Fatalf("forConnection() error = %v", err)
+		}
+		got := []string{}
+		for _, name := range []string{"posts", "comments", "posts"} {
+			schema, table, err := connReader.resolveTableName(name)
+			if err != nil {
+				t.Fatalf("resolveTableName(%s) error = %v", name, err)
+			}
+			got = append(got, qualifiedTableName(schema, table))
+		}
+		conn.Close()
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("resolveTableName() = %s, want %s", strings.Join(got, " "), tt.want)
+		}
+		if len(testRows.queries) != 3 || testRows.queries[0] != searchPathQuery {
+			t.Errorf("resolveTableName() executed %d queries, want the search_path and 2 tables", len(testRows.queries))
+		}
+	}
+}
+
+func TestDialectNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "mysql is not rewritten",
+			dialect: MySQL,
+			query:   `SELECT p.id::text FROM posts p WHERE p.content ILIKE $1`,
+			want:    `SELECT p.id::text FROM posts p WHERE p.content ILIKE $1`,
+		},
+		{
+			name:    "casts, parameters and ilike",
+			dialect: Postgres,
+			query:   "SELECT p.id::text AS id, p.content::character varying(255) FROM posts p WHERE p.content NOT ILIKE $1 AND p.id = $2::int -- PATH p $.posts[]",
+			want:    "select p.id as id, p.content from posts p where p.content not like :v1 and p.id = :v2 -- PATH p $.posts[]",
+		},
+		{
+			name:    "literals are kept",
+			dialect: Postgres,
+			query:   `SELECT 'a::b $1 ILIKE' AS "x::y", E'it''s' FROM posts`,
+			want:    "select 'a::b $1 ILIKE' as `x::y`, 'it''s' from posts",
+		},
+		{
+			name:    "quoted identifiers",
+			dialect: Postgres,
+			query:   `SELECT i."Name" FROM analytics."Order Items" i -- PATH i $."Order Items"`,
+			want:    "select i.`Name` from analytics.`Order Items` i -- PATH i $.\"Order Items\"",
+		},
+		{
+			name:    "distinct on and lateral",
+			dialect: Postgres,
+			query:   `SELECT DISTINCT ON (p.id, (p.category_id)) p.id, c.id FROM posts p LEFT JOIN LATERAL (SELECT id FROM comments WHERE post_id = p.id LIMIT 3) c ON true`,
+			want:    `select distinct p.id, c.id from posts p left join (select id from comments where post_id = p.id limit 3) c on true`,
+		},
+		{
+			name:    "insert returning",
+			dialect: Postgres,
+			query:   `INSERT INTO posts (category_id, content) VALUES ($1, 'x') RETURNING id, content -- PATH posts $`,
+			want:    "select id, content -- PATH posts $\nfrom posts",
+		},
+		{
+			name:    "update returning",
+			dialect: Postgres,
+			query:   `UPDATE posts p SET content = $1 WHERE p.id = $2 RETURNING p.id, p.content`,
+			want:    "select p.id, p.content\nfrom posts p",
+		},
+		{
+			name:    "delete returning",
+			dialect: Postgres,
+			query:   `DELETE FROM comments WHERE post_id = $1 RETURNING id`,
+			want:    "select id\nfrom comments",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.normalize(tt.query); got != tt.want {
+				t.Errorf("normalize() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryPrinter(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "mysql literals are kept",
+			dialect: MySQL,
+			query:   "SELECT p.id, 'it\\'s', \"x\" FROM `Posts` p WHERE p.content = 'a''b' # comment\nLIMIT 10, 5",
+			want:    "select p.id, 'it\\'s', \"x\" from Posts as p where p.content = 'a''b' limit 10, 5",
+		},
+		{
+			name:    "postgres casts, parameters and ilike",
+			dialect: Postgres,
+			query:   `SELECT P.Id::text AS id FROM Posts P WHERE P.Content NOT ILIKE :Search AND P.id = $1::int LIMIT 5 OFFSET 10`,
+			want:    `select p.id::text as id from posts as p where p.content not ilike :Search and p.id = $1::int limit 5 offset 10`,
+		},
+		{
+			name:    "postgres literals and quoted names",
+			dialect: Postgres,
+			query:   `SELECT i."Name", E'it\'s', 'a\', $$b$$ FROM analytics."Order Items" i`,
+			want:    `select i."Name", E'it\'s', 'a\', $$b$$ from analytics."Order Items" as i`,
+		},
+		{
+			name:    "postgres select without from",
+			dialect: Postgres,
+			query:   `SELECT 1 AS "select"`,
+			want:    `select 1 as "select"`,
+		},
+		{
+			name:    "postgres concatenation",
+			dialect: Postgres,
+			query:   `SELECT p.id || p.content FROM posts p`,
+		},
+		{
+			name:    "postgres distinct on",
+			dialect: Postgres,
+			query:   `SELECT DISTINCT ON (p.id) p.id FROM posts p`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, printer, err := parseQuery(tt.query, tt.dialect)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("parseQuery() = %s, want an error", printer.String(stmt))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseQuery() error = %v", err)
+			}
+			if got := printer.String(stmt); got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeQueryDialect(t *testing.T) {
+	query := `SELECT DISTINCT ON (p.id) p.id::text, c.message FROM posts p
+		LEFT JOIN comments c ON c.post_id = p.id
+		WHERE c.message ILIKE $1 -- PATH p $.posts[]`
+	analysis, err := AnalyzeQueryDialect(query, Postgres)
+	if err != nil {
+		t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+	}
+	engine := NewPathInferenceEngine(newStaticMetadataReader())
+	columns := []string{}
+	for _, column := range analysis.Columns {
+		columns = append(columns, column.Source(column.Name, analysis))
+	}
+	paths, err := engine.InferPaths(analysis, columns)
+	if err != nil {
+		t.Fatalf("InferPaths() error = %v", err)
+	}
+	got := fmt.Sprint(len(analysis.Joins), analysis.Joins[0].OnColumns, paths)
+	want := "1 [{c post_id p id}] map[c.message:$.posts[].c[].message p.id:$.posts[].id]"
+	if got != want {
+		t.Errorf("AnalyzeQueryDialect() = %s, want %s", got, want)
+	}
+}
+
+func TestSchemaQualifiedNames(t *testing.T) {
+	metadata := &staticMetadataReader{
+		tables: map[string]*TableMetadata{
+			"orders":                {Schema: "public", Name: "orders", Columns: []string{"id"}, PrimaryKeys: []string{"id"}},
+			"analytics.orders":      {Schema: "analytics", Name: "orders", Columns: []string{"id", "total"}, PrimaryKeys: []string{"id"}},
+			"analytics.Order Items": {Schema: "analytics", Name: "Order Items", Columns: []string{"id", "order_id", "name"}, PrimaryKeys: []string{"id"}},
+			"shop.orders":           {Schema: "shop", Name: "orders", Columns: []string{"id", "total"}, PrimaryKeys: []string{"id"}},
+			"warehouse.Order Items": {Schema: "warehouse", Name: "Order Items", Columns: []string{"id", "order_id", "name"}, PrimaryKeys: []string{"id"}},
+		},
+		foreignKeys: []ForeignKey{
+			{FromSchema: "analytics", FromTable: "Order Items", ToSchema: "analytics", ToTable: "orders", Columns: []ColumnPair{{From: "order_id", To: "id"}}},
+			{FromSchema: "warehouse", FromTable: "Order Items", ToSchema: "shop", ToTable: "orders", Columns: []ColumnPair{{From: "order_id", To: "id"}}},
+		},
+	}
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "double-quoted table in a schema",
+			dialect: Postgres,
+			query:   `SELECT o.id, i.name FROM analytics.orders o JOIN analytics."Order Items" i ON i.order_id = o.id`,
+			want:    "map[i:analytics.Order Items o:analytics.orders] map[i.name:$[].i[].name o.id:$[].o.id]",
+		},
+		{
+			name:    "backtick-quoted tables in different databases",
+			dialect: MySQL,
+			query:   "SELECT i.name, o.id FROM warehouse.`Order Items` i JOIN `shop`.`orders` o ON i.order_id = o.id",
+			want:    "map[i:warehouse.Order Items o:shop.orders] map[i.name:$[].i.name o.id:$[].o.id]",
+		},
+		{
+			name:    "unaliased quoted table under a path hint",
+			dialect: Postgres,
+			query:   `SELECT "Order Items".name FROM analytics."Order Items" -- PATH "Order Items" $.items[]`,
+			want:    "map[Order Items:analytics.Order Items] map[Order Items.name:$.items[].name]",
+		},
+		{
+			name:    "regex fallback on a full join",
+			dialect: MySQL,
+			query:   "SELECT o.id, i.name FROM `shop`.`orders` o FULL OUTER JOIN warehouse.`Order Items` AS `i` ON `i`.order_id = o.id",
+			want:    "map[i:warehouse.Order Items o:shop.orders] map[i.name:$[].i[].name o.id:$[].o.id]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQueryDialect(tt.query, tt.dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+			}
+			columns := []string{}
+			for _, column := range analysis.Columns {
+				columns = append(columns, column.Source(column.Name, analysis))
+			}
+			paths, err := NewPathInferenceEngine(metadata).InferPaths(analysis, columns)
+			if err != nil {
+				t.Fatalf("InferPaths() error = %v", err)
+			}
+			if got := fmt.Sprint(analysis.Tables, " ", paths); got != tt.want {
+				t.Errorf("InferPaths() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The foreign keys of a derived table keep the schema of the table they reference
+	analysis, err := AnalyzeQueryDialect(`WITH items AS (SELECT id, order_id FROM warehouse."Order Items") SELECT i.id, o.id FROM items i JOIN shop.orders o ON i.order_id = o.id`, Postgres)
+	if err != nil {
+		t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+	}
+	fks, err := analysis.metadataReader(metadata).GetForeignKeys("items")
+	if err != nil {
+		t.Fatalf("GetForeignKeys() error = %v", err)
+	}
+	if got, want := fmt.Sprint(fks), "[{  items shop orders [{order_id id}]}]"; got != want {
+		t.Errorf("GetForeignKeys() = %s, want %s", got, want)
+	}
+}
+
+func TestIdentifierCase(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "folded unquoted names",
+			dialect: Postgres,
+			query:   `SELECT P.ID, C.Message FROM Posts P JOIN Comments c ON C.Post_ID = p.id -- PATH p $.posts`,
+			want:    "map[c:comments p:posts] map[c.message:$.posts[].c[].message p.id:$.posts[].id]",
+		},
+		{
+			name:    "quoted names keep their case",
+			dialect: Postgres,
+			query:   `SELECT p.id, c."Message" FROM "Posts" p JOIN Comments c ON c.post_id = p.id -- PATH p $.posts`,
+			want:    "map[c:comments p:Posts] map[c.Message:$.posts[].c.Message p.id:$.posts[].id]",
+		},
+		{
+			name:    "unaliased parent named after its foreign key",
+			dialect: MySQL,
+			query:   "SELECT c.id, Posts.content FROM Comments c JOIN Posts ON c.POST_ID = posts.ID",
+			want:    "map[Posts:Posts c:Comments] map[Posts.content:$[].post.content c.id:$[].c.id]",
+		},
+		{
+			name:    "unqualified column and hints in another case",
+			dialect: MySQL,
+			query:   "SELECT Message, p.id FROM posts p LEFT JOIN comments C ON c.post_id = P.id -- PATH P $.posts\n-- LIMIT C 3",
+			want:    "map[C:comments p:posts] map[Message:$.posts[].C[].Message p.id:$.posts[].id] map[C:3]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQueryDialect(tt.query, tt.dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+			}
+			columns := []string{}
+			for _, column := range analysis.Columns {
+				columns = append(columns, column.Source(column.Name, analysis))
+			}
+			metadata := newStaticMetadataReader()
+			metadata.exact = tt.dialect == Postgres
+			paths, err := NewPathInferenceEngine(metadata).InferPaths(analysis, columns)
+			if err != nil {
+				t.Fatalf("InferPaths() error = %v", err)
+			}
+			got := fmt.Sprint(analysis.Tables, " ", paths)
+			if len(analysis.LimitHints) > 0 {
+				limits := map[string]int{}
+				for alias, hint := range analysis.LimitHints {
+					limits[alias] = hint.Limit
+				}
+				got = fmt.Sprint(got, " ", limits)
+			}
+			if got != tt.want {
+				t.Errorf("InferPaths() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHintDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "block comment",
+			dialect: MySQL,
+			query:   `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id /* PATH p $.posts */`,
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "hash comment in the middle",
+			dialect: MySQL,
+			query:   "SELECT p.id # PATH p $.posts[]\nFROM posts p WHERE p.id > 1",
+			want:    "map[p:$.posts[]] map[] p",
+		},
+		{
+			name:    "optimizer hint with several directives",
+			dialect: MySQL,
+			query:   "SELECT /*+ PATH p $.posts\n LIMIT c 3\n ORDER BY c.id DESC */ p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id",
+			want:    "map[p:$.posts] map[c:3 [{c id true}]] p",
+		},
+		{
+			name:    "several directives in a line comment",
+			dialect: MySQL,
+			query:   `SELECT p.id, c.id FROM posts p JOIN comments c ON c.post_id = p.id -- ROOT c; PATH c $.comments`,
+			want:    "map[c:$.comments] map[] c",
+		},
+		{
+			name:    "string literals are ignored",
+			dialect: MySQL,
+			query:   `SELECT p.id FROM posts p WHERE p.content = '-- PATH p $.wrong' -- PATH p $.posts`,
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "hash is an operator in postgres",
+			dialect: Postgres,
+			query:   "SELECT p.id FROM posts p WHERE p.id # 1 = 0 # PATH p $.wrong\n/* PATH p $.posts */",
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "hint in a clause that is rewritten",
+			dialect: Postgres,
+			query:   `INSERT INTO posts (content) /* PATH posts $ */ VALUES ($1) RETURNING id`,
+			want:    "map[posts:$] map[] posts",
+		},
+		{
+			name:    "escaped quote in a string literal",
+			dialect: MySQL,
+			query:   `SELECT p.id, 'it\'s -- PATH p $.leak' AS x FROM posts p -- PATH p $.posts`,
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "backslash in a postgres string literal",
+			dialect: Postgres,
+			query:   `SELECT p.id, 'a\' AS x, E'it\'s -- PATH p $.leak' AS y FROM posts p -- PATH p $.posts`,
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "one directive per line",
+			dialect: MySQL,
+			query:   `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id /* PATH p $.posts PATH c $.comments */`,
+			want:    "map[p:$.posts] map[] p",
+		},
+		{
+			name:    "keywords in the text of a comment",
+			dialect: MySQL,
+			query:   "SELECT p.id, c.id FROM posts p JOIN comments c ON c.post_id = p.id -- the root c is not the post\n/* no LIMIT c 3 and no PATH c $.comments */",
+			want:    "map[] map[] p",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQueryDialect(tt.query, tt.dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQueryDialect() error = %v", err)
+			}
+			limits := map[string]string{}
+			for alias, hint := range analysis.LimitHints {
+				limits[alias] = fmt.Sprint(hint.Limit, " ", hint.OrderBy)
+			}
+			got := fmt.Sprint(analysis.PathHints, " ", limits, " ", analysis.Root)
+			if got != tt.want {
+				t.Errorf("AnalyzeQueryDialect() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCombineOrphans(t *testing.T) {
+	db := &DB{}
+	paths := []string{"$[].p.id", "$[].c[].id"}
+	record := func(postID, commentID interface{}) *orderedmap.OrderedMap {
+		record := orderedmap.New()
+		record.Set("[].p.id", postID)
+		record.Set("[].c[].id", commentID)
+		return record
+	}
+
+	// Rows of a FULL JOIN: a post without comments and comments without a post
+	records := []*orderedmap.OrderedMap{record(1, 1), record(1, 2), record(nil, 3), record(nil, 4), record(2, nil)}
+	result, err := db.combineRecordsIntoTree(records, paths, map[string]string{"$[].p": "FULL", "$[].c[]": "FULL"})
+	if err != nil {
+		t.Fatalf("combineRecordsIntoTree() error = %v", err)
+	}
+	got, _ := json.Marshal(result)
+	want := `[{"p":{"id":1},"c":[{"id":1},{"id":2}]},{"p":null,"c":[{"id":3}]},{"p":null,"c":[{"id":4}]},{"p":{"id":2},"c":[]}]`
+	if string(got) != want {
+		t.Errorf("combineRecordsIntoTree() = %s, want %s", got, want)
+	}
+
+	// The missing child of a LEFT JOIN row leaves an empty array
+	result, err = db.combineRecordsIntoTree([]*orderedmap.OrderedMap{record(2, nil)}, paths, map[string]string{"$[].c[]": "LEFT"})
+	if err != nil {
+		t.Fatalf("combineRecordsIntoTree() error = %v", err)
+	}
+	got, _ = json.Marshal(result)
+	want = `[{"p":{"id":2},"c":[]}]`
+	if string(got) != want {
+		t.Errorf("combineRecordsIntoTree() = %s, want %s", got, want)
+	}
+}
+
+func TestEmptyResult(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"$[].id"}, `[]`},
+		{[]string{"$[].p.id", "$[].c[].id"}, `[]`},
+		{[]string{"$.posts[].id", "$.posts[].c[].id"}, `{"posts":[]}`},
+		{[]string{"$.posts[].id", "$.photos[].id"}, `{"posts":[],"photos":[]}`},
+		{[]string{"$.x.id"}, `[]`},
+		{[]string{"$.id"}, `[]`},
+	}
+
+	db := &DB{}
+	for _, tt := range tests {
+		result, err := db.combineRecordsIntoTree(nil, tt.paths, nil)
+		if err != nil {
+			t.Fatalf("combineRecordsIntoTree(%v) error = %v", tt.paths, err)
+		}
+		if got, _ := json.Marshal(result); string(got) != tt.want {
+			t.Errorf("combineRecordsIntoTree(%v) = %s, want %s", tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestOuterPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "inner joined parents are never missing",
+			query: `SELECT c.id, p.id, cat.id FROM comments c JOIN posts p ON c.post_id = p.id JOIN categories cat ON p.category_id = cat.id`,
+			want:  "[]",
+		},
+		{
+			name:  "left joined parent",
+			query: `SELECT c.id, p.id, cat.id FROM comments c JOIN posts p ON c.post_id = p.id LEFT JOIN categories cat ON p.category_id = cat.id`,
+			want:  "[$[].p.cat LEFT]",
+		},
+		{
+			name:  "left joined children",
+			query: `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id`,
+			want:  "[$[].c[] LEFT]",
+		},
+		{
+			name:  "both sides of a full join",
+			query: `SELECT p.id, c.id FROM posts p FULL OUTER JOIN comments c ON c.post_id = p.id`,
+			want:  "[$[].c[] FULL $[].p FULL]",
+		},
+	}
+
+	db := &DB{metadataReader: newStaticMetadataReader()}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := AnalyzeQuery(tt.query)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			columns := []string{}
+			for _, column := range analysis.Columns {
+				columns = append(columns, column.Name)
+			}
+			mapping, paths, err := db.columnPaths(analysis, columns)
+			if err != nil {
+				t.Fatalf("columnPaths() error = %v", err)
+			}
+			got := []string{}
+			for path, joinType := range outerPaths(analysis, mapping, paths) {
+				got = append(got, path+" "+joinType)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("outerPaths() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// A parent that is joined with an inner join is kept, also when its values are NULL
+	record := orderedmap.New()
+	record.Set("[].c.id", 1)
+	record.Set("[].p.id", nil)
+	result, err := db.combineRecordsIntoTree([]*orderedmap.OrderedMap{record}, []string{"$[].c.id", "$[].p.id"}, map[string]string{})
+	if err != nil {
+		t.Fatalf("combineRecordsIntoTree() error = %v", err)
+	}
+	if got, _ := json.Marshal(result); string(got) != `[{"c":{"id":1},"p":{"id":null}}]` {
+		t.Errorf("combineRecordsIntoTree() = %s", got)
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	hint := TreeHint{Alias: "c", ParentColumn: "parent_id", IDColumn: "id", ChildrenKey: "children"}
+	node := func(id, parentID interface{}) interface{} {
+		object := orderedmap.New()
+		object.Set("id", id)
+		object.Set("parent_id", parentID)
+		return object
+	}
+
+	tree, err := buildTree([]interface{}{node(1, nil), node(2, 1), node(3, 2), node(4, 99)}, hint)
+	if err != nil {
+		t.Fatalf("buildTree() error = %v", err)
+	}
+	got, _ := json.Marshal(tree)
+	want := `[{"id":1,"parent_id":null,"children":[{"id":2,"parent_id":1,"children":[{"id":3,"parent_id":2,"children":[]}]}]},{"id":4,"parent_id":99,"children":[]}]`
+	if string(got) != want {
+		t.Errorf("buildTree() = %s, want %s", got, want)
+	}
+
+	_, err = buildTree([]interface{}{node(1, nil), node(2, 3), node(3, 2)}, hint)
+	if err == nil {
+		t.Error("buildTree() with a cycle should return error")
+	}
+}
+
+func TestPlanSplitQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		query    string
+		branches []string
+	}{
+		{
+			name:     "sibling arrays",
+			query:    `SELECT p.id, c.id, t.name FROM posts p LEFT JOIN comments c ON c.post_id = p.id LEFT JOIN post_tags pt ON pt.post_id = p.id LEFT JOIN tags t ON pt.tag_id = t.id WHERE p.id = :id ORDER BY p.id, c.id`,
+			branches: []string{"select c.id, c.post_id as pathsqlx_fk from comments as c order by c.id asc", "select t.name, pt.post_id as pathsqlx_fk from post_tags as pt left join tags as t on pt.tag_id = t.id"},
+		},
+		{
+			name:     "many-to-one parent stays in the main query",
+			query:    `SELECT p.id, cat.name, c.id FROM posts p JOIN categories cat ON p.category_id = cat.id LEFT JOIN comments c ON c.post_id = p.id AND c.message IS NOT NULL`,
+			branches: []string{"select c.id, c.post_id as pathsqlx_fk from comments as c where c.message is not null"},
+		},
+		{
+			name:     "stars are expanded",
+			query:    `SELECT p.*, c.* FROM posts p LEFT JOIN comments c ON c.post_id = p.id`,
+			branches: []string{"select c.id, c.post_id, c.message, c.post_id as pathsqlx_fk from comments as c"},
+		},
+		{
+			name:  "inner join filters the parents",
+			query: `SELECT p.id, c.id FROM posts p JOIN comments c ON c.post_id = p.id`,
+		},
+		{
+			name:  "filter on the branch",
+			query: `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id WHERE c.message = 'nice!'`,
+		},
+		{
+			name:  "limit applies to the joined rows",
+			query: `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id LIMIT 10`,
+		},
+		{
+			name:     "postgres queries keep their syntax",
+			dialect:  Postgres,
+			query:    `SELECT p.id, c."message" FROM posts p LEFT JOIN comments c ON c.post_id = p.id AND c.message::text ILIKE E'it\'s%'`,
+			branches: []string{`select c."message", c.post_id as pathsqlx_fk from comments as c where c."message"::text ilike E'it\'s%'`},
+		},
+	}
+
+	db := &DB{metadataReader: newStaticMetadataReader()}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialect := tt.dialect
+			if dialect == "" {
+				dialect = MySQL
+			}
+			analysis, err := AnalyzeQueryDialect(tt.query, dialect)
+			if err != nil {
+				t.Fatalf("AnalyzeQuery() error = %v", err)
+			}
+			analysis.ExpandStars(db.metadataReader)
+			plan, ok := db.planSplitQuery(tt.query, analysis)
+			if ok != (len(tt.branches) > 0) {
+				t.Fatalf("planSplitQuery() split = %v, want %v", ok, len(tt.branches) > 0)
+			}
+			if !ok {
+				return
+			}
+			if len(plan.branches) != len(tt.branches) {
+				t.Fatalf("planSplitQuery() has %d branches, want %d", len(plan.branches), len(tt.branches))
+			}
+			for i, branch := range plan.branches {
+				if got := plan.printer.String(branch.query); got != tt.branches[i] {
+					t.Errorf("branch %d = %s, want %s", i, got, tt.branches[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitQueryResult(t *testing.T) {
+	sqlDB, err := sql.Open("pathsqlx_rows", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	db := NewDb(sqlDB, "postgres")
+	db.metadataReader = newStaticMetadataReader()
+	query := `SELECT p.id, c.id FROM posts p LEFT JOIN comments c ON c.post_id = p.id ORDER BY p.id, c.id`
+
+	// The joined rows, and the rows of the main query and the branch query when split
+	testRows.columns, testRows.rows = []string{"id", "id"}, [][]driver.Value{{int64(1), int64(1)}, {int64(1), int64(2)}, {int64(2), nil}}
+	testRows.results = map[string]*rowsDriver{
+		"pathsqlx_key_0": {columns: []string{"id", "pathsqlx_key_0"}, rows: [][]driver.Value{{int64(1), int64(1)}, {int64(2), int64(2)}}},
+		"pathsqlx_fk":    {columns: []string{"id", "pathsqlx_fk"}, rows: [][]driver.Value{{int64(1), int64(1)}, {int64(2), int64(1)}}},
+	}
+	defer func() { testRows.results = nil }()
+
+	want := `[{"p":{"id":1},"c":[{"id":1},{"id":2}]},{"p":{"id":2},"c":[]}]`
+	for _, split := range []bool{false, true} {
+		db.SplitQueries = split
+		testRows.queries = nil
+		result, err := db.PathQuery(query, map[string]interface{}{})
+		if err != nil {
+			t.Fatalf("PathQuery() split %v error = %v", split, err)
+		}
+		if got, _ := json.Marshal(result); string(got) != want {
+			t.Errorf("PathQuery() split %v = %s, want %s", split, got, want)
+		}
+		if split && (len(testRows.queries) != 2 || !strings.Contains(testRows.queries[1], "in ($1, $2)")) {
+			t.Errorf("PathQuery() split queries = %q", testRows.queries)
+		}
+	}
+}
+
+func TestSplitQueries(t *testing.T) {
+	queries := []string{
+		`SELECT p.id, p.content, c.id, c.message, t.name FROM posts p LEFT JOIN comments c ON c.post_id = p.id LEFT JOIN post_tags pt ON pt.post_id = p.id LEFT JOIN tags t ON pt.tag_id = t.id ORDER BY p.id, c.id, t.id`,
+		`SELECT cat.id, cat.name, p.id, c.id FROM categories cat LEFT JOIN posts p ON p.category_id = cat.id LEFT JOIN comments c ON c.post_id = p.id ORDER BY cat.id, p.id, c.id`,
+	}
+	wants := []string{
+		`[{"p":{"id":1,"content":"blog started"},"c":[{"id":1,"message":"great!"},{"id":2,"message":"nice!"}],"t":[{"name":"news"},{"name":"blog"}]},{"p":{"id":2,"content":"second post"},"c":[{"id":3,"message":"interesting"},{"id":4,"message":"cool"}],"t":[{"name":"blog"}]}]`,
+		`[{"cat":{"id":1,"name":"announcement"},"p":[{"id":1,"c":[{"id":1},{"id":2}]},{"id":2,"c":[{"id":3},{"id":4}]}]},{"cat":{"id":2,"name":"article"},"p":[]},{"cat":{"id":3,"name":"release"},"p":[]}]`,
+	}
+
+	for _, dbCfg := range getTestDatabases() {
+		t.Run(dbCfg.name, func(t *testing.T) {
+			db := setupTestDB(t, dbCfg)
+			defer func() {
+				db.Exec("DROP TABLE IF EXISTS post_tags")
+				db.Exec("DROP TABLE IF EXISTS tags")
+				db.Exec("DROP TABLE IF EXISTS comments")
+				db.Exec("DROP TABLE IF EXISTS posts")
+				db.Exec("DROP TABLE IF EXISTS categories")
+				db.Close()
+			}()
+
+			// The split and the single query return the same result
+			for _, split := range []bool{true, false} {
+				db.SplitQueries = split
+				for i, query := range queries {
+					got, err := db.PathQuery(query, map[string]interface{}{})
+					if err != nil {
+						t.Fatalf("PathQuery() error = %v", err)
+					}
+					gotJSON, _ := json.Marshal(got)
+					if string(gotJSON) != wants[i] {
+						t.Errorf("PathQuery() split %v = %s, want %s", split, gotJSON, wants[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPathLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		db    *DB
+		paths []string
+		limit string
+	}{
+		{
+			name:  "no limits",
+			db:    &DB{},
+			paths: []string{"$[].p.id", "$[].c[].id", "$[].t[].id"},
+		},
+		{
+			name:  "sibling arrays",
+			db:    &DB{MaxSiblingArrays: 1},
+			paths: []string{"$[].p.id", "$[].c[].id", "$[].t[].id"},
+			limit: "MaxSiblingArrays",
+		},
+		{
+			name:  "nested arrays are not siblings",
+			db:    &DB{MaxSiblingArrays: 1},
+			paths: []string{"$.posts[].id", "$.posts[].comments[].id", "$.posts[].comments[].likes[].id"},
+		},
+		{
+			name:  "too deep",
+			db:    &DB{MaxDepth: 3},
+			paths: []string{"$[].p.id", "$[].c[].l[].id"},
+			limit: "MaxDepth",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.db.checkPathLimits(tt.paths)
+			if tt.limit == "" {
+				if err != nil {
+					t.Errorf("checkPathLimits() error = %v", err)
+				}
+				return
+			}
+			limitErr, ok := err.(*LimitError)
+			if !ok || limitErr.Limit != tt.limit {
+				t.Errorf("checkPathLimits() error = %v, want %s", err, tt.limit)
+			}
+		})
+	}
+}
+
+func TestPathQueryPage(t *testing.T) {
+	query := `SELECT p.id, c.id, c.message FROM posts p LEFT JOIN comments c ON c.post_id = p.id ORDER BY c.id -- PATH p $.posts`
+	wants := []string{
+		`{"posts":[{"id":1,"c":[{"id":1,"message":"great!"},{"id":2,"message":"nice!"}]}]}`,
+		`{"posts":[{"id":2,"c":[{"id":3,"message":"interesting"},{"id":4,"message":"cool"}]}]}`,
+	}
+
+	for _, dbCfg := range getTestDatabases() {
+		t.Run(dbCfg.name, func(t *testing.T) {
+			db := setupTestDB(t, dbCfg)
+			defer func() {
+				db.Exec("DROP TABLE IF EXISTS post_tags")
+				db.Exec("DROP TABLE IF EXISTS tags")
+				db.Exec("DROP TABLE IF EXISTS comments")
+				db.Exec("DROP TABLE IF EXISTS posts")
+				db.Exec("DROP TABLE IF EXISTS categories")
+				db.Close()
+			}()
+
+			query, arg := query, map[string]interface{}{}
+			if DialectOf(dbCfg.driver) == Postgres {
+				// The page queries keep the casts, ILIKE and quoted names of the query
+				query = `SELECT p.id, c.id, c."message" FROM posts p LEFT JOIN comments c ON c.post_id = p.id WHERE p.content::text ILIKE :content ORDER BY c.id -- PATH p $.posts`
+				arg["content"] = "%"
+			}
+			cursor := ""
+			for i, want := range wants {
+				got, next, err := db.PathQueryPage(query, arg, 1, cursor)
+				if err != nil {
+					t.Fatalf("PathQueryPage() error = %v", err)
+				}
+				gotJSON, _ := json.Marshal(got)
+				if string(gotJSON) != want {
+					t.Errorf("PathQueryPage() page %d = %s, want %s", i+1, gotJSON, want)
+				}
+				if (next == "") != (i == len(wants)-1) {
+					t.Errorf("PathQueryPage() page %d next cursor = %q", i+1, next)
+				}
+				cursor = next
+			}
+		})
+	}
+}
+
+func TestPathQueryPageQueries(t *testing.T) {
+	sqlDB, err := sql.Open("pathsqlx_rows", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	db := NewDb(sqlDB, "postgres")
+	db.metadataReader = newStaticMetadataReader()
+	testRows.columns, testRows.rows, testRows.queries = []string{"id", "content"}, [][]driver.Value{{int64(1), "a"}, {int64(2), "b"}}, nil
+
+	cursor, _ := encodeCursor(int64(0))
+	_, next, err := db.PathQueryPage(`SELECT P.id, P."content" FROM Posts P WHERE P.content ILIKE :Search`, map[string]interface{}{"Search": "%"}, 1, cursor)
+	if err != nil {
+		t.Fatalf("PathQueryPage() error = %v", err)
+	}
+	if next == "" {
+		t.Errorf("PathQueryPage() has no next page")
+	}
+	want := []string{
+		`select distinct p."id" from posts as p where p."content" ilike $1 and p."id" > $2 order by p."id" asc limit 2`,
+		`select p."id", p."content" from posts as p where p."content" ilike $1 and p."id" > $2 and p."id" <= $3 order by p."id" asc`,
+	}
+	if strings.Join(testRows.queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("PathQueryPage() queries = %q, want %q", testRows.queries, want)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	for _, value := range []interface{}{int64(42), "abc", 1.5} {
+		cursor, err := encodeCursor(value)
+		if err != nil {
+			t.Fatalf("encodeCursor(%v) error = %v", value, err)
+		}
+		got, err := decodeCursor(cursor)
+		if err != nil || got != value {
+			t.Errorf("decodeCursor(encodeCursor(%v)) = %v, %v", value, got, err)
+		}
+	}
+	if _, err := decodeCursor("not a cursor"); err == nil {
+		t.Error("decodeCursor() with an invalid cursor should return error")
+	}
+}
+
+func TestLimitArrays(t *testing.T) {
+	query := `SELECT p.id, c.id, c.message FROM posts p LEFT JOIN comments c ON c.post_id = p.id -- LIMIT comments 2 ORDER BY comments.message DESC, c.id`
+	analysis, err := AnalyzeQuery(query)
+	if err != nil {
+		t.Fatalf("AnalyzeQuery() error = %v", err)
+	}
+	hint, ok := analysis.LimitHints["c"]
+	if !ok || hint.Limit != 2 || len(hint.OrderBy) != 2 || !hint.OrderBy[0].Desc || hint.OrderBy[1].Desc {
+		t.Fatalf("AnalyzeQuery() LimitHints = %+v", analysis.LimitHints)
+	}
+
+	comment := func(id int64, message string) interface{} {
+		object := orderedmap.New()
+		object.Set("id", id)
+		object.Set("message", message)
+		return object
+	}
+	post := orderedmap.New()
+	post.Set("c", []interface{}{comment(1, "a"), comment(2, "b"), comment(3, "b"), comment(4, "a")})
+	db := &DB{}
+	got, err := db.limitArrays([]interface{}{post}, hint, []string{"p.id", "c.id", "c.message"}, []string{"$[].p.id", "$[].c[].id", "$[].c[].message"})
+	if err != nil {
+		t.Fatalf("limitArrays() error = %v", err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	want := `[{"c":[{"id":2,"message":"b"},{"id":3,"message":"b"}]}]`
+	if string(gotJSON) != want {
+		t.Errorf("limitArrays() = %s, want %s", gotJSON, want)
+	}
+}
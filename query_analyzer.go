@@ -1,8 +1,9 @@
 package pathsqlx
 
 import (
-	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/xwb1989/sqlparser"
@@ -17,6 +18,8 @@ type JoinInfo struct {
 	JoinType   string // "LEFT", "INNER", "RIGHT", etc.
 	Condition  string
 	OnColumns  []JoinColumn
+	Using      []string // columns of a USING clause
+	Natural    bool     // NATURAL join, the columns are resolved from metadata
 }
 
 // JoinColumn represents column information in a join condition
@@ -33,35 +36,152 @@ type PathHint struct {
 	Path  string
 }
 
+// TreeHint represents a TREE directive from SQL comments for a self-referencing table
+type TreeHint struct {
+	Alias        string
+	ParentColumn string
+	IDColumn     string
+	ChildrenKey  string
+}
+
+// LimitHint represents a LIMIT directive from SQL comments for a nested array
+type LimitHint struct {
+	Alias   string
+	Limit   int
+	OrderBy []OrderHint
+}
+
+// OrderHint is a column of the ORDER BY of a LIMIT directive
+type OrderHint struct {
+	Alias  string
+	Column string
+	Desc   bool
+}
+
+// SelectColumn is an output column of the SELECT clause
+type SelectColumn struct {
+	Name   string // name in the result: the AS alias or the column, "" for unnamed expressions
+	Alias  string // table alias of a qualified column or star
+	Column string // underlying column, "" for expressions
+	Expr   string // expression of a computed column, "" for columns
+	Star   bool   // * or alias.*
+}
+
 // QueryAnalysis contains the parsed query structure
 type QueryAnalysis struct {
-	Tables    map[string]string // alias -> table name
-	Joins     []JoinInfo
-	PathHints map[string]string // alias -> path override
+	Dialect     Dialect
+	Tables      map[string]string // alias -> table name
+	Aliases     []string          // aliases in FROM-clause order
+	Root        string            // alias of the root of the join tree
+	Columns     []SelectColumn    // output columns in SELECT-clause order
+	Joins       []JoinInfo
+	PathHints   map[string]string              // alias -> path override
+	TreeHints   map[string]TreeHint            // alias -> tree directive
+	LimitHints  map[string]LimitHint           // alias -> per-parent limit
+	Polymorphic map[string]PolymorphicRelation // alias -> polymorphic association
+	Derived     map[string]*DerivedTable       // CTE or "(subquery alias)" -> lineage
+	Branches    []*QueryAnalysis               // analysis of each branch of a UNION
 }
 
 // AnalyzeQuery parses a SQL query to extract structure information
 // Uses Vitess SQL parser to correctly handle subqueries, CTEs, and complex expressions
 // Falls back to regex parsing if SQL parsing fails (e.g., for non-standard SQL)
 func AnalyzeQuery(sql string) (*QueryAnalysis, error) {
+	return AnalyzeQueryDialect(sql, MySQL)
+}
+
+// AnalyzeQueryDialect parses a SQL query of a dialect to extract structure information
+// The syntax of the dialect that the parser doesn't support is rewritten before parsing.
+func AnalyzeQueryDialect(sql string, dialect Dialect) (*QueryAnalysis, error) {
+	// The directives are read before the query is rewritten, from all of its comments
+	hints := hintDirectives(sql, dialect)
+	sql = dialect.normalize(sql)
 	analysis := &QueryAnalysis{
-		Tables:    make(map[string]string),
-		Joins:     []JoinInfo{},
-		PathHints: make(map[string]string),
+		Dialect:     dialect,
+		Tables:      make(map[string]string),
+		Joins:       []JoinInfo{},
+		PathHints:   make(map[string]string),
+		TreeHints:   make(map[string]TreeHint),
+		LimitHints:  make(map[string]LimitHint),
+		Polymorphic: make(map[string]PolymorphicRelation),
+		Derived:     make(map[string]*DerivedTable),
 	}
 
 	// Extract path hints from comments
-	analysis.PathHints = extractPathHints(sql)
+	analysis.PathHints = extractPathHints(hints)
+
+	// Extract tree directives from comments
+	analysis.TreeHints = extractTreeHints(hints)
+
+	// Extract the CTEs of a WITH clause, the query after them is analyzed
+	query := extractCTEs(sql, analysis)
+
+	// Extract the branches of a UNION, the first branch is analyzed as the query
+	query = extractUnionBranches(query, analysis)
+
+	// Refer to the tables by their declared aliases, whatever their case
+	query = matchQualifiers(query)
 
 	// Extract tables and aliases from FROM clause
-	extractFromClause(sql, analysis)
+	extractFromClause(query, analysis)
+
+	// Extract the output columns from SELECT clause
+	extractSelectColumns(query, analysis)
 
 	// Extract JOINs
-	extractJoins(sql, analysis)
+	extractJoins(query, analysis)
+
+	// Match the aliases of the hints to the tables
+	analysis.matchHintAliases()
+
+	// Extract polymorphic associations from comments
+	extractPolymorphicHints(hints, analysis)
+
+	// Extract per-parent limits from comments
+	extractLimitHints(hints, analysis)
+
+	// Determine the root of the join tree, a ROOT directive overrides the FROM clause
+	extractRootHint(hints, analysis)
 
 	return analysis, nil
 }
 
+// hintDirectives returns the directives in the comments of a query, one per line as
+// "-- DIRECTIVE arguments". They are read from line comments (-- and, in MySQL, #) and
+// block comments (also optimizer hints: /*+ ... */) anywhere in the query. A directive
+// starts a comment, a line of a block comment or follows a ";", so a comment may hold
+// several directives. Text after a directive on its line belongs to its arguments: in
+// "PATH p $.x PATH c $.y" the second PATH is not a directive. Text in string literals is
+// not a comment.
+func hintDirectives(sql string, dialect Dialect) string {
+	keyword := regexp.MustCompile(`(?im)(?:^|;)\s*((?:PATH|TREE|POLYMORPHIC|ROOT|LIMIT)\b)`)
+	_, literals := maskLiterals(sql, dialect)
+	var directives strings.Builder
+	for _, literal := range literals {
+		var body string
+		switch {
+		case strings.HasPrefix(literal, "--"):
+			body = literal[2:]
+		case strings.HasPrefix(literal, "#"):
+			body = literal[1:]
+		case strings.HasPrefix(literal, "/*"):
+			body = strings.TrimPrefix(strings.TrimSuffix(literal[2:], "*/"), "+")
+		default:
+			continue
+		}
+		matches := keyword.FindAllStringSubmatchIndex(body, -1)
+		for i, match := range matches {
+			end := len(body)
+			if i+1 < len(matches) {
+				end = matches[i+1][2]
+			}
+			directive := strings.Join(strings.Fields(body[match[2]:end]), " ")
+			directives.WriteString("-- " + strings.TrimRight(directive, ";") + "\n")
+		}
+	}
+	return directives.String()
+}
+
 // extractPathHints extracts PATH hints from SQL comments
 // Format: -- PATH table_alias $.path or -- PATH: table_alias $.path
 // PATH hints apply to table aliases only, not individual columns
@@ -72,12 +192,12 @@ func extractPathHints(sql string) map[string]string {
 	// Match: -- PATH[:]? table_alias $.path
 	// Allow $ alone or followed by word chars, brackets, dots, or asterisks
 	// table_alias can be a word or $ for queries without tables
-	re := regexp.MustCompile(`--\s*PATH:?\s+(\$|\w+)\s+(\$[\w\[\]\.\*]*)`)
+	re := regexp.MustCompile(`--\s*PATH:?\s+(\$|` + identifierPattern + `)\s+(\$[\w\[\]\.\*]*)`)
 	matches := re.FindAllStringSubmatch(sql, -1)
 
 	for _, match := range matches {
 		if len(match) == 3 {
-			alias := match[1]
+			alias := unquoteIdentifier(match[1])
 			path := match[2]
 			hints[alias] = path
 		}
@@ -86,6 +206,164 @@ func extractPathHints(sql string) map[string]string {
 	return hints
 }
 
+// extractTreeHints extracts TREE directives from SQL comments
+// Format: -- TREE table_alias parent_column -> id_column [AS children_key]
+// The rows of the alias are nested by their parent column, children default to "children"
+func extractTreeHints(sql string) map[string]TreeHint {
+	hints := make(map[string]TreeHint)
+
+	re := regexp.MustCompile(`(?i)--\s*TREE:?\s+(` + identifierPattern + `)\s+(` + identifierPattern + `)\s*->\s*(` + identifierPattern + `)(?:\s+AS\s+(` + identifierPattern + `))?`)
+	matches := re.FindAllStringSubmatch(sql, -1)
+
+	for _, match := range matches {
+		if len(match) == 5 {
+			hint := TreeHint{
+				Alias:        unquoteIdentifier(match[1]),
+				ParentColumn: unquoteIdentifier(match[2]),
+				IDColumn:     unquoteIdentifier(match[3]),
+				ChildrenKey:  unquoteIdentifier(match[4]),
+			}
+			if hint.ChildrenKey == "" {
+				hint.ChildrenKey = "children"
+			}
+			hints[hint.Alias] = hint
+		}
+	}
+
+	return hints
+}
+
+// extractPolymorphicHints extracts POLYMORPHIC directives from SQL comments
+// Format: -- POLYMORPHIC table_alias type_column id_column
+// The id column of the alias references the tables joined on it, selected by the type column
+func extractPolymorphicHints(sql string, analysis *QueryAnalysis) {
+	re := regexp.MustCompile(`(?i)--\s*POLYMORPHIC:?\s+(` + identifierPattern + `)\s+(` + identifierPattern + `)\s+(` + identifierPattern + `)`)
+	matches := re.FindAllStringSubmatch(sql, -1)
+
+	for _, match := range matches {
+		if len(match) == 4 {
+			alias := matchAlias(unquoteIdentifier(match[1]), analysis)
+			table := alias
+			if t, ok := analysis.Tables[alias]; ok {
+				table = t
+			}
+			analysis.Polymorphic[alias] = PolymorphicRelation{
+				Table:      table,
+				TypeColumn: analysis.Dialect.identifier(match[2]),
+				IDColumn:   analysis.Dialect.identifier(match[3]),
+			}
+		}
+	}
+}
+
+// extractRootHint extracts the ROOT directive from SQL comments and sets the root
+// Format: -- ROOT table_alias
+// Without a directive the root is the first table in the FROM clause that isn't joined,
+// or the preserved (right) side of a RIGHT JOIN. When the root is not the first table,
+// the joins between the FROM clause and the new root are reversed.
+func extractRootHint(sql string, analysis *QueryAnalysis) {
+	re := regexp.MustCompile(`(?i)--\s*ROOT:?\s+(` + identifierPattern + `)`)
+	match := re.FindStringSubmatch(sql)
+	if match != nil {
+		alias := resolveAlias(unquoteIdentifier(match[1]), analysis)
+		if _, ok := analysis.Tables[alias]; ok {
+			analysis.Root = alias
+			analysis.rerootJoins(alias)
+			return
+		}
+	}
+	for i := range analysis.Joins {
+		join := analysis.Joins[i]
+		if join.JoinType == "RIGHT" && join.RightAlias != "" && join.LeftAlias != "" {
+			analysis.Root = join.RightAlias
+			analysis.rerootJoins(join.RightAlias)
+		}
+	}
+	analysis.Root = analysis.RootAlias()
+}
+
+// extractLimitHints extracts LIMIT directives from SQL comments
+// Format: -- LIMIT table_alias count [ORDER BY alias.column [ASC|DESC], ...]
+// Table names are resolved to their alias, so "-- LIMIT comments 3" works for "comments c"
+func extractLimitHints(sql string, analysis *QueryAnalysis) {
+	re := regexp.MustCompile(`(?i)--\s*LIMIT:?\s+(` + identifierPattern + `)\s+(\d+)(?:[ \t]+ORDER[ \t]+BY[ \t]+([^\n]+))?`)
+	orderRe := regexp.MustCompile(`(?i)^(?:(` + identifierPattern + `)\.)?(` + identifierPattern + `)(?:\s+(ASC|DESC))?$`)
+	matches := re.FindAllStringSubmatch(sql, -1)
+
+	for _, match := range matches {
+		if len(match) != 4 {
+			continue
+		}
+		limit, err := strconv.Atoi(match[2])
+		if err != nil {
+			continue
+		}
+		hint := LimitHint{Alias: resolveAlias(unquoteIdentifier(match[1]), analysis), Limit: limit}
+		if match[3] != "" {
+			for _, item := range strings.Split(match[3], ",") {
+				order := orderRe.FindStringSubmatch(strings.TrimSpace(item))
+				if order == nil {
+					continue
+				}
+				alias := hint.Alias
+				if order[1] != "" {
+					alias = resolveAlias(unquoteIdentifier(order[1]), analysis)
+				}
+				hint.OrderBy = append(hint.OrderBy, OrderHint{
+					Alias:  alias,
+					Column: unquoteIdentifier(order[2]),
+					Desc:   strings.EqualFold(order[3], "DESC"),
+				})
+			}
+		}
+		analysis.LimitHints[hint.Alias] = hint
+	}
+}
+
+// resolveAlias returns the alias of a table name that is used once in the query (or of
+// an alias in another case), other names are returned as is
+func resolveAlias(name string, analysis *QueryAnalysis) string {
+	if alias := matchAlias(name, analysis); alias != name {
+		return alias
+	}
+	if _, ok := analysis.Tables[name]; ok {
+		return name
+	}
+	alias := name
+	count := 0
+	for _, a := range analysis.OrderedAliases() {
+		table := analysis.Tables[a]
+		if strings.EqualFold(table, name) {
+			alias = a
+			count++
+		}
+	}
+	if count != 1 {
+		return name
+	}
+	return alias
+}
+
+// matchAlias returns the alias that a name refers to when it only differs in case from
+// a single alias, other names are returned as is
+func matchAlias(name string, analysis *QueryAnalysis) string {
+	if _, ok := analysis.Tables[name]; ok {
+		return name
+	}
+	alias := name
+	count := 0
+	for a := range analysis.Tables {
+		if strings.EqualFold(a, name) {
+			alias = a
+			count++
+		}
+	}
+	if count != 1 {
+		return name
+	}
+	return alias
+}
+
 // extractFromClause extracts table and alias from FROM clause using SQL parser
 func extractFromClause(sql string, analysis *QueryAnalysis) {
 	// Parse SQL using Vitess parser
@@ -111,17 +389,21 @@ func extractTablesFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysi
 	case *sqlparser.AliasedTableExpr:
 		switch expr := table.Expr.(type) {
 		case sqlparser.TableName:
-			tableName := expr.Name.String()
-			alias := tableName
+			tableName := analysis.tableName(expr)
+			alias := expr.Name.String()
 			if !table.As.IsEmpty() {
 				alias = table.As.String()
 			}
-			analysis.Tables[alias] = tableName
+			analysis.addTable(alias, tableName)
 		case *sqlparser.Subquery:
-			// Handle subquery with alias
+			// Handle subquery with alias, its columns are traced like those of a CTE
 			if !table.As.IsEmpty() {
 				alias := table.As.String()
-				analysis.Tables[alias] = "(subquery)"
+				name := "(subquery " + alias + ")"
+				analysis.addTable(alias, name)
+				if analysis.Derived != nil {
+					analysis.Derived[name] = derivedTableFromStatement(name, expr.Select)
+				}
 			}
 		}
 	case *sqlparser.JoinTableExpr:
@@ -136,6 +418,134 @@ func extractTablesFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysi
 	}
 }
 
+// identifierPattern matches a plain, backtick-quoted or double-quoted identifier
+const identifierPattern = "(?:\\w+|`(?:[^`]|``)+`|\"(?:[^\"]|\"\")+\")"
+
+// tableNamePattern matches a table name that may be qualified with a schema
+const tableNamePattern = identifierPattern + `(?:\.` + identifierPattern + `)?`
+
+// unquoteIdentifier removes the backticks or double quotes around an identifier
+func unquoteIdentifier(identifier string) string {
+	if len(identifier) < 2 {
+		return identifier
+	}
+	quote := identifier[:1]
+	if (quote != "`" && quote != `"`) || !strings.HasSuffix(identifier, quote) {
+		return identifier
+	}
+	return strings.Replace(identifier[1:len(identifier)-1], quote+quote, quote, -1)
+}
+
+// sameIdentifier checks whether two column names are the same, MySQL compares them
+// case-insensitively. PostgreSQL compares them exactly, the unquoted names of the query
+// are folded to lower case when it is normalized.
+func (d Dialect) sameIdentifier(a, b string) bool {
+	if d == Postgres {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// identifier returns the name of a (quoted) identifier in a directive or a WITH clause,
+// PostgreSQL folds unquoted names to lower case
+func (d Dialect) identifier(identifier string) string {
+	if name := unquoteIdentifier(identifier); name != identifier || d != Postgres {
+		return name
+	}
+	return strings.ToLower(identifier)
+}
+
+// unquoteTableName removes the quotes around the parts of a (schema-qualified) table name
+func unquoteTableName(name string) string {
+	parts := regexp.MustCompile(identifierPattern).FindAllString(name, -1)
+	for i, part := range parts {
+		parts[i] = unquoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// tableNameOf returns the name of a table, qualified with its schema (or database) when
+// the query qualifies it
+func tableNameOf(name sqlparser.TableName) string {
+	return qualifiedTableName(name.Qualifier.String(), name.Name.String())
+}
+
+// tableName returns the name of a table in the query, a name that only differs in case
+// from the name of a CTE refers to the CTE (in MySQL, PostgreSQL has folded the names)
+func (a *QueryAnalysis) tableName(name sqlparser.TableName) string {
+	tableName := tableNameOf(name)
+	if _, ok := a.Derived[tableName]; ok || !name.Qualifier.IsEmpty() || a.Dialect == Postgres {
+		return tableName
+	}
+	for derived := range a.Derived {
+		if strings.EqualFold(derived, tableName) {
+			return derived
+		}
+	}
+	return tableName
+}
+
+// matchQualifiers rewrites the qualifiers of the columns to the aliases as they are
+// declared in the FROM clause, when they only differ in case (PostgreSQL folds unquoted
+// names to lower case, so "P.id" refers to "p"), the declared aliases are the keys
+func matchQualifiers(query string) string {
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return query
+	}
+	declared := &QueryAnalysis{Tables: make(map[string]string)}
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if table, ok := node.(*sqlparser.AliasedTableExpr); ok {
+			if alias := tableAlias(table); alias != "" {
+				declared.addTable(alias, alias)
+			}
+		}
+		return true, nil
+	}, stmt)
+
+	changed := false
+	match := func(qualifier *sqlparser.TableName) {
+		if qualifier.Name.IsEmpty() || !qualifier.Qualifier.IsEmpty() {
+			return
+		}
+		if alias := matchAlias(qualifier.Name.String(), declared); alias != qualifier.Name.String() {
+			qualifier.Name = sqlparser.NewTableIdent(alias)
+			changed = true
+		}
+	}
+	_ = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch node := node.(type) {
+		case *sqlparser.ColName:
+			match(&node.Qualifier)
+		case *sqlparser.StarExpr:
+			match(&node.TableName)
+		}
+		return true, nil
+	}, stmt)
+	if !changed {
+		return query
+	}
+	return sqlparser.String(stmt)
+}
+
+// matchHintAliases matches the aliases of PATH and TREE hints to the aliases of the
+// tables when they only differ in case
+func (a *QueryAnalysis) matchHintAliases() {
+	for alias, path := range a.PathHints {
+		if matched := matchAlias(alias, a); matched != alias {
+			delete(a.PathHints, alias)
+			a.PathHints[matched] = path
+		}
+	}
+	for alias, hint := range a.TreeHints {
+		if matched := matchAlias(alias, a); matched != alias {
+			delete(a.TreeHints, alias)
+			hint.Alias = matched
+			a.TreeHints[matched] = hint
+		}
+	}
+}
+
 // extractFromClauseRegex is the fallback regex-based implementation
 func extractFromClauseRegex(sql string, analysis *QueryAnalysis) {
 	// Remove comments
@@ -143,8 +553,9 @@ func extractFromClauseRegex(sql string, analysis *QueryAnalysis) {
 
 	// Find FROM clause - stop at WHERE, JOIN, ORDER BY, GROUP BY, LIMIT, or HAVING
 	// Pattern: FROM table_name [AS] alias [, table_name [AS] alias]*
-	re := regexp.MustCompile(`(?i)FROM\s+(.+?)(?:\s+(?:WHERE|LEFT|RIGHT|INNER|OUTER|JOIN|ORDER|GROUP|LIMIT|HAVING)|$)`)
+	re := regexp.MustCompile(`(?i)FROM\s+(.+?)(?:\s+(?:WHERE|LEFT|RIGHT|FULL|INNER|OUTER|JOIN|ORDER|GROUP|LIMIT|HAVING)|$)`)
 	matches := re.FindStringSubmatch(sql)
+	tableSpecRe := regexp.MustCompile(`(?i)^(` + tableNamePattern + `)(?:\s+(?:AS\s+)?(` + identifierPattern + `))?`)
 
 	if len(matches) >= 2 {
 		tableList := matches[1]
@@ -157,30 +568,24 @@ func extractFromClauseRegex(sql string, analysis *QueryAnalysis) {
 				continue
 			}
 
-			// Parse: table_name [AS] alias
-			tableParts := regexp.MustCompile(`\s+`).Split(tableSpec, -1)
-			if len(tableParts) >= 1 {
-				tableName := tableParts[0]
-				alias := tableName
+			// Parse: [schema.]table_name [AS] alias
+			tableParts := tableSpecRe.FindStringSubmatch(tableSpec)
+			if tableParts != nil {
+				tableName := unquoteTableName(tableParts[1])
+				_, alias := splitTableName(tableName)
 
 				// Check for explicit alias
-				if len(tableParts) >= 2 {
-					// Check if second part is AS keyword
-					if len(tableParts) >= 3 && strings.ToUpper(tableParts[1]) == "AS" {
-						alias = tableParts[2]
-					} else if strings.ToUpper(tableParts[1]) != "AS" {
-						// No AS keyword, just alias
-						alias = tableParts[1]
-					}
+				if tableParts[2] != "" {
+					alias = unquoteIdentifier(tableParts[2])
 				}
 
 				// Make sure the alias is not a SQL keyword
 				upperAlias := strings.ToUpper(alias)
-				if upperAlias != "WHERE" && upperAlias != "LEFT" && upperAlias != "RIGHT" &&
+				if upperAlias != "WHERE" && upperAlias != "LEFT" && upperAlias != "RIGHT" && upperAlias != "FULL" &&
 					upperAlias != "INNER" && upperAlias != "OUTER" && upperAlias != "JOIN" &&
 					upperAlias != "ORDER" && upperAlias != "GROUP" && upperAlias != "LIMIT" &&
 					upperAlias != "HAVING" {
-					analysis.Tables[alias] = tableName
+					analysis.addTable(alias, tableName)
 				}
 			}
 		}
@@ -203,9 +608,110 @@ func extractJoins(sql string, analysis *QueryAnalysis) {
 		for _, tableExpr := range stmt.From {
 			extractJoinsFromExpr(tableExpr, analysis)
 		}
+		if len(stmt.From) > 1 && stmt.Where != nil {
+			extractImplicitJoins(stmt.From, stmt.Where.Expr, analysis)
+		}
 	}
 }
 
+// extractImplicitJoins synthesizes INNER joins for comma-separated FROM items from the
+// alias.column = alias.column conditions in the WHERE clause
+// Starting at the first FROM item, every item that is compared to an item that is
+// already joined is joined to it, so the join tree follows the FROM-clause order.
+func extractImplicitJoins(from sqlparser.TableExprs, where sqlparser.Expr, analysis *QueryAnalysis) {
+	// Only conditions combined with AND join the tables
+	conditions := []*sqlparser.ComparisonExpr{}
+	for _, condition := range splitConjunction(where) {
+		comparison, ok := condition.(*sqlparser.ComparisonExpr)
+		if !ok || comparison.Operator != sqlparser.EqualStr {
+			continue
+		}
+		left, leftOk := comparison.Left.(*sqlparser.ColName)
+		right, rightOk := comparison.Right.(*sqlparser.ColName)
+		if leftOk && rightOk && !left.Qualifier.IsEmpty() && !right.Qualifier.IsEmpty() {
+			conditions = append(conditions, comparison)
+		}
+	}
+
+	// Tables joined within a FROM item belong to that item
+	item := make(map[string]int)
+	for i, tableExpr := range from {
+		for _, alias := range tableExprAliases(tableExpr) {
+			item[alias] = i
+		}
+	}
+	joined := make(map[string]bool)
+	for _, join := range analysis.Joins {
+		joined[join.RightAlias] = true
+	}
+
+	connected := map[int]bool{0: true}
+	for progress := true; progress; {
+		progress = false
+		for _, condition := range conditions {
+			left := condition.Left.(*sqlparser.ColName).Qualifier.Name.String()
+			right := condition.Right.(*sqlparser.ColName).Qualifier.Name.String()
+			leftItem, leftOk := item[left]
+			rightItem, rightOk := item[right]
+			if !leftOk || !rightOk || connected[leftItem] == connected[rightItem] {
+				continue
+			}
+			parent, child := left, right
+			if connected[rightItem] {
+				parent, child = right, left
+			}
+			if joined[child] {
+				continue
+			}
+			analysis.Joins = append(analysis.Joins, implicitJoin(parent, child, conditions, analysis))
+			joined[child] = true
+			connected[item[child]] = true
+			progress = true
+		}
+	}
+}
+
+// implicitJoin creates the join of a child to its parent from all WHERE conditions between them
+func implicitJoin(parent, child string, conditions []*sqlparser.ComparisonExpr, analysis *QueryAnalysis) JoinInfo {
+	parts := []string{}
+	for _, condition := range conditions {
+		left := condition.Left.(*sqlparser.ColName).Qualifier.Name.String()
+		right := condition.Right.(*sqlparser.ColName).Qualifier.Name.String()
+		if (left == parent && right == child) || (left == child && right == parent) {
+			parts = append(parts, sqlparser.String(condition))
+		}
+	}
+	condition := strings.Join(parts, " and ")
+	return JoinInfo{
+		LeftAlias:  parent,
+		LeftTable:  analysis.Tables[parent],
+		RightAlias: child,
+		RightTable: analysis.Tables[child],
+		JoinType:   "INNER",
+		Condition:  condition,
+		OnColumns:  parseJoinCondition(condition),
+	}
+}
+
+// tableExprAliases returns the aliases of the tables in a table expression
+func tableExprAliases(tableExpr sqlparser.TableExpr) []string {
+	switch table := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		if alias := tableAlias(table); alias != "" {
+			return []string{alias}
+		}
+	case *sqlparser.JoinTableExpr:
+		return append(tableExprAliases(table.LeftExpr), tableExprAliases(table.RightExpr)...)
+	case *sqlparser.ParenTableExpr:
+		aliases := []string{}
+		for _, expr := range table.Exprs {
+			aliases = append(aliases, tableExprAliases(expr)...)
+		}
+		return aliases
+	}
+	return nil
+}
+
 // extractJoinsFromExpr recursively extracts joins from table expressions
 func extractJoinsFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysis) {
 	switch table := tableExpr.(type) {
@@ -218,16 +724,21 @@ func extractJoinsFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysis
 		rightTable := ""
 		if aliased, ok := table.RightExpr.(*sqlparser.AliasedTableExpr); ok {
 			if tableName, ok := aliased.Expr.(sqlparser.TableName); ok {
-				rightTable = tableName.Name.String()
-				rightAlias = rightTable
+				rightTable = analysis.tableName(tableName)
+				rightAlias = tableName.Name.String()
 				if !aliased.As.IsEmpty() {
 					rightAlias = aliased.As.String()
 				}
+			} else if !aliased.As.IsEmpty() {
+				// A derived table is known by its alias
+				rightAlias = aliased.As.String()
+				rightTable = analysis.Tables[rightAlias]
 			}
 		}
 
 		// Determine join type
 		joinType := "INNER"
+		natural := false
 		switch table.Join {
 		case sqlparser.LeftJoinStr:
 			joinType = "LEFT"
@@ -235,6 +746,14 @@ func extractJoinsFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysis
 			joinType = "RIGHT"
 		case sqlparser.JoinStr:
 			joinType = "INNER"
+		case sqlparser.NaturalJoinStr:
+			natural = true
+		case sqlparser.NaturalLeftJoinStr:
+			joinType = "LEFT"
+			natural = true
+		case sqlparser.NaturalRightJoinStr:
+			joinType = "RIGHT"
+			natural = true
 		}
 
 		// Parse ON condition
@@ -248,7 +767,22 @@ func extractJoinsFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysis
 		// Determine left table
 		leftAlias := ""
 		leftTable := ""
-		if len(onColumns) > 0 {
+		using := []string{}
+		if len(table.Condition.Using) > 0 || natural {
+			// USING and NATURAL joins refer to the nearest table on the left that has the
+			// column, until resolved from metadata assume the table right before the join
+			if leftAliases := tableExprAliases(table.LeftExpr); len(leftAliases) > 0 {
+				leftAlias = leftAliases[len(leftAliases)-1]
+				leftTable = analysis.Tables[leftAlias]
+			}
+			parts := []string{}
+			for _, column := range table.Condition.Using {
+				using = append(using, column.String())
+				parts = append(parts, leftAlias+"."+column.String()+" = "+rightAlias+"."+column.String())
+			}
+			condition = strings.Join(parts, " and ")
+			onColumns = parseJoinCondition(condition)
+		} else if len(onColumns) > 0 {
 			if onColumns[0].RightAlias == rightAlias {
 				leftAlias = onColumns[0].LeftAlias
 			} else if onColumns[0].LeftAlias == rightAlias {
@@ -270,6 +804,8 @@ func extractJoinsFromExpr(tableExpr sqlparser.TableExpr, analysis *QueryAnalysis
 				JoinType:   joinType,
 				Condition:  condition,
 				OnColumns:  onColumns,
+				Using:      using,
+				Natural:    natural,
 			}
 			analysis.Joins = append(analysis.Joins, joinInfo)
 		}
@@ -286,7 +822,9 @@ func extractJoinsRegex(sql string, analysis *QueryAnalysis) {
 
 	// Pattern for JOIN clauses - simplified without lookahead
 	// Matches: [LEFT|RIGHT|INNER|OUTER] JOIN table [AS] alias ON condition
-	re := regexp.MustCompile(`(?i)(LEFT\s+|RIGHT\s+|INNER\s+|OUTER\s+|CROSS\s+)?JOIN\s+(\w+)(?:\s+(?:AS\s+)?(\w+))?\s+ON\s+(.+)`)
+	re := regexp.MustCompile(`(?i)(LEFT\s+|RIGHT\s+|FULL\s+|INNER\s+|CROSS\s+)?(?:OUTER\s+)?JOIN\s+(` + tableNamePattern + `)(?:\s+(?:AS\s+)?(` + identifierPattern + `))?\s+ON\s+(.+)`)
+	// The condition ends at the next clause, "order_id" doesn't end it
+	stopRe := regexp.MustCompile(`(?i)\b(?:WHERE|GROUP|ORDER|LIMIT|HAVING)\b`)
 
 	matches := re.FindAllStringSubmatch(sql, -1)
 
@@ -294,29 +832,22 @@ func extractJoinsRegex(sql string, analysis *QueryAnalysis) {
 		joinType := strings.TrimSpace(strings.ToUpper(match[1]))
 		if joinType == "" {
 			joinType = "INNER"
-		} else {
-			joinType = strings.TrimSpace(joinType)
 		}
 
-		tableName := match[2]
-		alias := tableName
+		tableName := unquoteTableName(match[2])
+		_, alias := splitTableName(tableName)
 		if match[3] != "" {
-			alias = match[3]
+			alias = unquoteIdentifier(match[3])
 		}
 		condition := strings.TrimSpace(match[4])
 
-		// Trim condition at next JOIN, WHERE, GROUP BY, ORDER BY, or LIMIT
-		stopWords := []string{"WHERE", "GROUP BY", "GROUP", "ORDER BY", "ORDER", "LIMIT", "HAVING"}
-		for _, word := range stopWords {
-			idx := strings.Index(strings.ToUpper(condition), word)
-			if idx >= 0 {
-				condition = strings.TrimSpace(condition[:idx])
-				break
-			}
+		// Trim condition at next WHERE, GROUP BY, ORDER BY, LIMIT or HAVING
+		if loc := stopRe.FindStringIndex(condition); loc != nil {
+			condition = strings.TrimSpace(condition[:loc[0]])
 		}
 
 		// Add table to tables map
-		analysis.Tables[alias] = tableName
+		analysis.addTable(alias, tableName)
 
 		// Parse join condition
 		onColumns := parseJoinCondition(condition)
@@ -334,10 +865,10 @@ func extractJoinsRegex(sql string, analysis *QueryAnalysis) {
 				leftAlias = onColumns[0].RightAlias
 			} else {
 				// Neither matches, try to find from previous tables
-				for a, t := range analysis.Tables {
+				for _, a := range analysis.OrderedAliases() {
 					if a != alias {
 						leftAlias = a
-						leftTable = t
+						leftTable = analysis.Tables[a]
 						break
 					}
 				}
@@ -350,10 +881,10 @@ func extractJoinsRegex(sql string, analysis *QueryAnalysis) {
 			}
 		} else {
 			// No parseable condition, use first non-current table
-			for a, t := range analysis.Tables {
+			for _, a := range analysis.OrderedAliases() {
 				if a != alias {
 					leftAlias = a
-					leftTable = t
+					leftTable = analysis.Tables[a]
 					break
 				}
 			}
@@ -379,16 +910,16 @@ func parseJoinCondition(condition string) []JoinColumn {
 	var columns []JoinColumn
 
 	// Pattern: alias.column = alias.column
-	re := regexp.MustCompile(`(\w+)\.(\w+)\s*=\s*(\w+)\.(\w+)`)
+	re := regexp.MustCompile(`(` + identifierPattern + `)\.(` + identifierPattern + `)\s*=\s*(` + identifierPattern + `)\.(` + identifierPattern + `)`)
 	matches := re.FindAllStringSubmatch(condition, -1)
 
 	for _, match := range matches {
 		if len(match) == 5 {
 			col := JoinColumn{
-				LeftAlias:   match[1],
-				LeftColumn:  match[2],
-				RightAlias:  match[3],
-				RightColumn: match[4],
+				LeftAlias:   unquoteIdentifier(match[1]),
+				LeftColumn:  unquoteIdentifier(match[2]),
+				RightAlias:  unquoteIdentifier(match[3]),
+				RightColumn: unquoteIdentifier(match[4]),
 			}
 			columns = append(columns, col)
 		}
@@ -416,6 +947,103 @@ func (a *QueryAnalysis) GetTableForAlias(alias string) (string, bool) {
 	return table, ok
 }
 
+// addTable adds a table to the analysis, keeping the FROM-clause order of the aliases
+func (a *QueryAnalysis) addTable(alias, tableName string) {
+	if _, ok := a.Tables[alias]; !ok {
+		a.Aliases = append(a.Aliases, alias)
+	}
+	a.Tables[alias] = tableName
+}
+
+// OrderedAliases returns the aliases in FROM-clause order, tables that were added to
+// the map directly follow in alphabetical order
+func (a *QueryAnalysis) OrderedAliases() []string {
+	aliases := []string{}
+	seen := make(map[string]bool)
+	for _, alias := range a.Aliases {
+		if _, ok := a.Tables[alias]; ok && !seen[alias] {
+			aliases = append(aliases, alias)
+			seen[alias] = true
+		}
+	}
+	rest := []string{}
+	for alias := range a.Tables {
+		if !seen[alias] {
+			rest = append(rest, alias)
+		}
+	}
+	sort.Strings(rest)
+	return append(aliases, rest...)
+}
+
+// RootAlias returns the root of the join tree: the ROOT directive, or else the first
+// table in FROM-clause order that is not on the right side of a join
+func (a *QueryAnalysis) RootAlias() string {
+	if _, ok := a.Tables[a.Root]; ok {
+		return a.Root
+	}
+	joinedAliases := make(map[string]bool)
+	for _, join := range a.Joins {
+		joinedAliases[join.RightAlias] = true
+	}
+	for _, alias := range a.OrderedAliases() {
+		if !joinedAliases[alias] {
+			return alias
+		}
+	}
+	return ""
+}
+
+// rerootJoins reverses the joins on the path from the root to the first table of the
+// FROM clause, so that every table is again joined to its parent in the join tree
+func (a *QueryAnalysis) rerootJoins(root string) {
+	chain := []int{}
+	visited := map[string]bool{root: true}
+	alias := root
+	for {
+		index := -1
+		for i := range a.Joins {
+			if a.Joins[i].RightAlias == alias {
+				index = i
+				break
+			}
+		}
+		if index < 0 || a.Joins[index].LeftAlias == "" || visited[a.Joins[index].LeftAlias] {
+			break
+		}
+		chain = append(chain, index)
+		alias = a.Joins[index].LeftAlias
+		visited[alias] = true
+	}
+	for _, i := range chain {
+		join := &a.Joins[i]
+		join.LeftAlias, join.RightAlias = join.RightAlias, join.LeftAlias
+		join.LeftTable, join.RightTable = join.RightTable, join.LeftTable
+		switch join.JoinType {
+		case "LEFT":
+			join.JoinType = "RIGHT"
+		case "RIGHT":
+			join.JoinType = "LEFT"
+		}
+	}
+}
+
+// outerJoinedAliases returns the aliases of the tables that may be missing from a row, with
+// their join type: the right table of a LEFT join, the left table of a RIGHT join and both
+// tables of a FULL join
+func (a *QueryAnalysis) outerJoinedAliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, join := range a.Joins {
+		if isOuterJoin(join) && aliases[join.RightAlias] != "FULL" {
+			aliases[join.RightAlias] = strings.TrimSuffix(join.JoinType, " OUTER")
+		}
+		if join.JoinType == "FULL" || join.JoinType == "RIGHT" && aliases[join.LeftAlias] != "FULL" {
+			aliases[join.LeftAlias] = join.JoinType
+		}
+	}
+	return aliases
+}
+
 // GetJoinForTable returns join information for a table alias
 func (a *QueryAnalysis) GetJoinForTable(alias string) *JoinInfo {
 	for i := range a.Joins {
@@ -462,85 +1090,137 @@ func splitRespectingParentheses(s string) []string {
 	return result
 }
 
-// parseSelectClause parses the SELECT clause to map columns to their source tables
-// Returns a slice of column identifiers (table.column or alias) in the order they appear
-func parseSelectClause(query string, analysis *QueryAnalysis) []string {
-	// Extract SELECT clause
-	reSelect := regexp.MustCompile(`(?i)SELECT\s+(.+?)\s+FROM\s+`)
-	matches := reSelect.FindStringSubmatch(query)
-
-	if len(matches) < 2 {
-		return []string{}
+// Source returns the column as "alias.column" when it is a column of a table in the
+// query, or else the given name of the column in the result
+func (c SelectColumn) Source(name string, analysis *QueryAnalysis) string {
+	if c.Alias != "" && c.Column != "" && !c.Star {
+		if _, ok := analysis.Tables[c.Alias]; ok {
+			return c.Alias + "." + name
+		}
 	}
+	return name
+}
 
-	selectClause := matches[1]
-	columnSources := []string{}
-
-	// Split by comma, but respect parentheses (for subqueries and functions)
-	columns := splitRespectingParentheses(selectClause)
-
-	for _, col := range columns {
-		col = strings.TrimSpace(col)
-
-		// Check if it has an AS clause
-		if strings.Contains(strings.ToUpper(col), " AS ") {
-			parts := regexp.MustCompile(`(?i)\s+AS\s+`).Split(col, 2)
-			if len(parts) == 2 {
-				aliasName := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
-				// Use the alias name as the column identifier
-				columnSources = append(columnSources, aliasName)
-				continue
-			}
+// ExpandStars replaces the * and alias.* columns by the columns of their tables, in the
+// order of the table metadata, so that every result column is attributed to its table.
+// A star that can't be expanded (subqueries, unknown tables, an unqualified star with a
+// USING or NATURAL join) is kept, as are the stars after it.
+func (a *QueryAnalysis) ExpandStars(metadata MetadataReader) {
+	metadata = a.metadataReader(metadata)
+	columns := []SelectColumn{}
+	for i, column := range a.Columns {
+		if !column.Star {
+			columns = append(columns, column)
+			continue
+		}
+		expanded, ok := a.expandStar(column.Alias, metadata)
+		if !ok {
+			columns = append(columns, a.Columns[i:]...)
+			break
 		}
+		columns = append(columns, expanded...)
+	}
+	a.Columns = columns
+}
 
-		// Check if it's table.column format
-		if strings.Contains(col, ".") && !strings.Contains(col, "(") {
-			parts := strings.SplitN(col, ".", 2)
-			if len(parts) == 2 {
-				tableAlias := strings.TrimSpace(parts[0])
-				colName := strings.TrimSpace(parts[1])
-				columnSources = append(columnSources, fmt.Sprintf("%s.%s", tableAlias, colName))
-				continue
+// expandStar returns the columns of a star, of all tables in FROM-clause order when the
+// alias is empty
+func (a *QueryAnalysis) expandStar(alias string, metadata MetadataReader) ([]SelectColumn, bool) {
+	aliases := []string{alias}
+	if alias == "" {
+		for _, join := range a.Joins {
+			if len(join.Using) > 0 || join.Natural {
+				// The joined columns are merged into one
+				return nil, false
 			}
 		}
+		aliases = a.OrderedAliases()
+	}
+	columns := []SelectColumn{}
+	for _, alias := range aliases {
+		tableName, ok := a.Tables[alias]
+		if !ok || metadata == nil {
+			return nil, false
+		}
+		table, err := metadata.GetTableMetadata(tableName)
+		if err != nil || len(table.Columns) == 0 {
+			return nil, false
+		}
+		for _, column := range table.Columns {
+			columns = append(columns, SelectColumn{Name: column, Alias: alias, Column: column})
+		}
+	}
+	return columns, true
+}
 
-		// Column without table prefix or expression
-		// Try to infer from context
-		colName := strings.TrimSpace(col)
+// extractSelectColumns extracts the output columns from SELECT clause using SQL parser
+func extractSelectColumns(sql string, analysis *QueryAnalysis) {
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		// Fall back to regex if parse fails
+		extractSelectColumnsRegex(sql, analysis)
+		return
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return
+	}
+	for _, selectExpr := range sel.SelectExprs {
+		analysis.Columns = append(analysis.Columns, selectColumn(selectExpr))
+	}
+}
 
-		// Check if it's an expression (contains parentheses)
-		if strings.Contains(colName, "(") {
-			// It's an expression, use as-is (will be handled as a special case)
-			columnSources = append(columnSources, colName)
-		} else {
-			// Simple column name, infer table
-			var tableAlias string
-			if len(analysis.Tables) == 1 {
-				for alias := range analysis.Tables {
-					tableAlias = alias
-					break
-				}
-			} else {
-				// Find root table
-				joinedAliases := make(map[string]bool)
-				for _, join := range analysis.Joins {
-					joinedAliases[join.RightAlias] = true
-				}
-				for alias := range analysis.Tables {
-					if !joinedAliases[alias] {
-						tableAlias = alias
-						break
-					}
-				}
+// selectColumn resolves a select expression to its source alias and column
+func selectColumn(selectExpr sqlparser.SelectExpr) SelectColumn {
+	switch expr := selectExpr.(type) {
+	case *sqlparser.StarExpr:
+		return SelectColumn{Alias: expr.TableName.Name.String(), Star: true}
+	case *sqlparser.AliasedExpr:
+		column := SelectColumn{Name: expr.As.String()}
+		if colName, ok := expr.Expr.(*sqlparser.ColName); ok {
+			column.Alias = colName.Qualifier.Name.String()
+			column.Column = colName.Name.String()
+			if column.Name == "" {
+				column.Name = column.Column
 			}
+		} else {
+			column.Expr = sqlparser.String(expr.Expr)
+		}
+		return column
+	}
+	return SelectColumn{Expr: sqlparser.String(selectExpr)}
+}
 
-			if tableAlias != "" {
-				columnSources = append(columnSources, fmt.Sprintf("%s.%s", tableAlias, colName))
+// extractSelectColumnsRegex is the fallback regex-based implementation
+func extractSelectColumnsRegex(sql string, analysis *QueryAnalysis) {
+	sql = removeComments(sql)
+	re := regexp.MustCompile(`(?is)SELECT\s+(?:DISTINCT\s+)?(.+?)\s+FROM\s+`)
+	matches := re.FindStringSubmatch(sql)
+	if len(matches) < 2 {
+		return
+	}
+	reAs := regexp.MustCompile(`(?i)\s+AS\s+`)
+	reColumn := regexp.MustCompile(`^(?:(` + identifierPattern + `)\.)?(` + identifierPattern + `|\*)$`)
+	for _, part := range splitRespectingParentheses(matches[1]) {
+		part = strings.TrimSpace(part)
+		column := SelectColumn{}
+		if parts := reAs.Split(part, 2); len(parts) == 2 {
+			part = strings.TrimSpace(parts[0])
+			column.Name = unquoteIdentifier(strings.Trim(strings.TrimSpace(parts[1]), "'"))
+		}
+		if m := reColumn.FindStringSubmatch(part); m != nil {
+			column.Alias = unquoteIdentifier(m[1])
+			if m[2] == "*" {
+				column.Star = true
 			} else {
-				columnSources = append(columnSources, colName)
+				column.Column = unquoteIdentifier(m[2])
+				if column.Name == "" {
+					column.Name = column.Column
+				}
 			}
+		} else {
+			column.Expr = part
 		}
+		analysis.Columns = append(analysis.Columns, column)
 	}
-
-	return columnSources
 }
@@ -0,0 +1,187 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// textPrefix is the prefix of the parameters that stand for the text of the query that
+// the parser can't read (string literals, casts, ...) and that is printed as written
+const textPrefix = ":pathsqlx_text_"
+
+var (
+	reStringPrefix       = regexp.MustCompile("(?i)\\b([ebnx])\x00(\\d+)\x00")
+	rePostgresNamedParam = regexp.MustCompile(`(^|[^\w:]):([A-Za-z_]\w*)`)
+	rePostgresOperator   = regexp.MustCompile(`#|\|\||&&`)
+	reSimpleIdentifier   = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// queryPrinter formats a parsed query (or a query generated from it) in the dialect of
+// the query: the parser reads and writes MySQL syntax only, so the text it can't read is
+// kept aside and the names are quoted like the dialect quotes them
+type queryPrinter struct {
+	dialect   Dialect
+	fragments []string        // text of the query, printed as written
+	quoted    map[string]bool // names that are quoted (PostgreSQL)
+}
+
+// parseQuery parses a query of a dialect for rewriting, the printer formats the rewritten
+// query in that dialect
+func parseQuery(sql string, dialect Dialect) (sqlparser.Statement, *queryPrinter, error) {
+	p := &queryPrinter{dialect: dialect, quoted: map[string]bool{}}
+	masked, literals := maskLiterals(sql, dialect)
+	// The prefix of a string literal is part of it: E'...', B'...', N'...', X'...'
+	masked = reStringPrefix.ReplaceAllStringFunc(masked, func(placeholder string) string {
+		match := reStringPrefix.FindStringSubmatch(placeholder)
+		i, _ := strconv.Atoi(match[2])
+		if !strings.HasPrefix(literals[i], "'") {
+			return placeholder
+		}
+		literals[i] = match[1] + literals[i]
+		return placeholder[len(match[1]):]
+	})
+	if dialect == Postgres {
+		// Operators that MySQL reads with another meaning or that have no equivalent
+		if match := rePostgresOperator.FindString(masked); match != "" {
+			return nil, nil, fmt.Errorf("unsupported operator: %s", match)
+		}
+		if rePostgresDistinct.MatchString(masked) || rePostgresLateral.MatchString(masked) {
+			return nil, nil, fmt.Errorf("unsupported syntax: DISTINCT ON or LATERAL")
+		}
+		// Named parameters keep their case
+		masked = rePostgresNamedParam.ReplaceAllStringFunc(masked, func(param string) string {
+			match := rePostgresNamedParam.FindStringSubmatch(param)
+			return match[1] + p.text(":"+match[2])
+		})
+		// A cast is printed after the expression that it applies to: p.id::text is
+		// "p.id ^ :text", ^ binds stronger than the operators around it
+		masked = rePostgresCast.ReplaceAllStringFunc(masked, func(cast string) string {
+			return " ^ " + p.text(cast)
+		})
+		masked = rePostgresParameter.ReplaceAllStringFunc(masked, p.text)
+		masked = rePostgresILike.ReplaceAllString(masked, "REGEXP")
+		// Unquoted names are folded like in the analysis
+		masked = strings.ToLower(masked)
+	}
+	masked = reMaskedLiteral.ReplaceAllStringFunc(masked, func(placeholder string) string {
+		i, _ := strconv.Atoi(strings.Trim(placeholder, "\x00"))
+		literal := literals[i]
+		switch {
+		case strings.HasPrefix(literal, "--") || strings.HasPrefix(literal, "/*") || strings.HasPrefix(literal, "#"):
+			return " "
+		case strings.HasPrefix(literal, "`"):
+			return literal
+		case strings.HasPrefix(literal, `"`) && dialect == Postgres:
+			name := unquoteIdentifier(literal)
+			p.quoted[name] = true
+			return quoteIdentifier(name)
+		}
+		return p.text(literal)
+	})
+	stmt, err := sqlparser.Parse(masked)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stmt, p, nil
+}
+
+// text returns the parameter that stands for a text of the query
+func (p *queryPrinter) text(text string) string {
+	p.fragments = append(p.fragments, text)
+	return textPrefix + strconv.Itoa(len(p.fragments)-1)
+}
+
+// fragment returns the text of the query that a parameter stands for
+func (p *queryPrinter) fragment(node sqlparser.SQLNode) (string, bool) {
+	val, ok := node.(*sqlparser.SQLVal)
+	if !ok || val.Type != sqlparser.ValArg || !strings.HasPrefix(string(val.Val), textPrefix) {
+		return "", false
+	}
+	i, err := strconv.Atoi(string(val.Val[len(textPrefix):]))
+	if err != nil || i >= len(p.fragments) {
+		return "", false
+	}
+	return p.fragments[i], true
+}
+
+// quote returns a name (of the catalog) that is always quoted
+func (p *queryPrinter) quote(name string) sqlparser.ColIdent {
+	if p.dialect == Postgres {
+		p.quoted[name] = true
+	}
+	return sqlparser.NewColIdent(name)
+}
+
+// String formats a node in the dialect of the query
+func (p *queryPrinter) String(node sqlparser.SQLNode) string {
+	buf := sqlparser.NewTrackedBuffer(p.format)
+	buf.Myprintf("%v", node)
+	return buf.String()
+}
+
+// format formats a node, the nodes that have another syntax in PostgreSQL are formatted
+// here, the others by the parser
+func (p *queryPrinter) format(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+	if text, ok := p.fragment(node); ok {
+		buf.WriteString(text)
+		return
+	}
+	if p.dialect != Postgres {
+		node.Format(buf)
+		return
+	}
+	switch node := node.(type) {
+	case sqlparser.ColIdent:
+		p.formatName(buf, node.String())
+	case sqlparser.TableIdent:
+		p.formatName(buf, node.String())
+	case *sqlparser.BinaryExpr:
+		if cast, ok := p.fragment(node.Right); ok && node.Operator == sqlparser.BitXorStr && strings.HasPrefix(cast, "::") {
+			buf.Myprintf("%v%s", node.Left, cast)
+			return
+		}
+		node.Format(buf)
+	case *sqlparser.ComparisonExpr:
+		switch node.Operator {
+		case sqlparser.RegexpStr:
+			buf.Myprintf("%v ilike %v", node.Left, node.Right)
+		case sqlparser.NotRegexpStr:
+			buf.Myprintf("%v not ilike %v", node.Left, node.Right)
+		default:
+			node.Format(buf)
+		}
+	case *sqlparser.ConvertExpr:
+		buf.Myprintf("cast(%v as %v)", node.Expr, node.Type)
+	case *sqlparser.Select:
+		buf.Myprintf("select %v%s%v", node.Comments, node.Distinct, node.SelectExprs)
+		// A SELECT without FROM is read as a SELECT from dual
+		if len(node.From) != 1 || sqlparser.String(node.From[0]) != "dual" {
+			buf.Myprintf(" from %v", node.From)
+		}
+		buf.Myprintf("%v%v%v%v%v%s", node.Where, node.GroupBy, node.Having, node.OrderBy, node.Limit, node.Lock)
+	case *sqlparser.Limit:
+		if node == nil {
+			return
+		}
+		buf.Myprintf(" limit %v", node.Rowcount)
+		if node.Offset != nil {
+			buf.Myprintf(" offset %v", node.Offset)
+		}
+	default:
+		node.Format(buf)
+	}
+}
+
+// formatName formats a name in PostgreSQL, quoted when the query quotes it or when it
+// isn't a name that PostgreSQL reads as it is
+func (p *queryPrinter) formatName(buf *sqlparser.TrackedBuffer, name string) {
+	if name == "" || (!p.quoted[name] && reSimpleIdentifier.MatchString(name)) {
+		buf.WriteString(name)
+		return
+	}
+	buf.WriteString(`"` + strings.Replace(name, `"`, `""`, -1) + `"`)
+}
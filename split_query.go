@@ -0,0 +1,591 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/iancoleman/orderedmap"
+	"github.com/xwb1989/sqlparser"
+)
+
+// splitBatchSize is the maximum number of parent keys in the IN list of a branch query
+const splitBatchSize = 1000
+
+// splitPlan is a path query split into a main query and one query per one-to-many branch
+type splitPlan struct {
+	main     *sqlparser.Select
+	paths    []string
+	branches []*splitBranch
+	columns  []string // output column names of the original query
+	mapping  []string // alias.column mapping of the original query
+	original []string // paths of the original query
+	outer    map[string]string
+	printer  *queryPrinter
+}
+
+// splitBranch is a one-to-many branch of the join tree that is fetched with its own query
+type splitBranch struct {
+	rootAlias  string
+	aliases    map[string]bool
+	steps      []joinStep
+	parentKey  *sqlparser.ColName
+	childKey   *sqlparser.ColName
+	conditions []sqlparser.Expr
+	exprs      sqlparser.SelectExprs
+	paths      []string
+	outer      map[string]string
+	orderBy    sqlparser.OrderBy
+	query      *sqlparser.Select
+	keyColumn  string // hidden column with the parent key in the main query
+	container  string // path of the objects that get the branch array
+	key        string // JSON key of the branch array
+}
+
+// joinStep is a table in a left-deep join tree with the join that added it
+type joinStep struct {
+	table *sqlparser.AliasedTableExpr
+	alias string
+	join  string
+	on    sqlparser.Expr
+}
+
+// planSplitQuery splits a query along its one-to-many LEFT JOINs, so that sibling arrays
+// don't multiply each other's rows. Returns false when the query can't be split without
+// changing its result: GROUP BY, DISTINCT, LIMIT, filters on the branches, etc.
+func (db *DB) planSplitQuery(query string, analysis *QueryAnalysis) (*splitPlan, bool) {
+	stmt, printer, err := parseQuery(query, analysis.Dialect)
+	if err != nil {
+		return nil, false
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok || sel.Distinct != "" || len(sel.GroupBy) > 0 || sel.Having != nil || sel.Limit != nil || sel.Lock != "" || len(sel.From) != 1 {
+		return nil, false
+	}
+	steps, ok := flattenJoins(sel.From[0])
+	if !ok || len(steps) < 2 || steps[0].alias != analysis.RootAlias() {
+		return nil, false
+	}
+
+	// Resolve the output column of each select expression
+	columns := []string{}
+	mapping := []string{}
+	for _, column := range analysis.Columns {
+		if column.Star || column.Name == "" || strings.HasPrefix(column.Name, "$") {
+			return nil, false
+		}
+		columns = append(columns, column.Name)
+		mapping = append(mapping, column.Source(column.Name, analysis))
+	}
+	engine := db.newPathInferenceEngine()
+	inferred := engine.InferPathsWithFallback(analysis, mapping)
+	paths := make([]string, len(mapping))
+	for i, col := range mapping {
+		paths[i] = inferred[col]
+	}
+	cardinality, err := engine.forQuery(analysis).buildCardinalityMap(analysis)
+	if err != nil {
+		return nil, false
+	}
+
+	// Assign every joined table to the main query or to a branch
+	mainAliases := map[string]bool{steps[0].alias: true}
+	mainSteps := []joinStep{steps[0]}
+	branchOf := map[string]*splitBranch{}
+	branches := []*splitBranch{}
+	for _, step := range steps[1:] {
+		parentAlias := ""
+		if join := analysis.GetJoinForTable(step.alias); join != nil {
+			parentAlias = join.LeftAlias
+		}
+		refs, ok := referencedAliases(step.on)
+		if !ok {
+			return nil, false
+		}
+		if branch, ok := branchOf[parentAlias]; ok {
+			for alias := range refs {
+				if alias != step.alias && !branch.aliases[alias] {
+					return nil, false
+				}
+			}
+			branch.aliases[step.alias] = true
+			branch.steps = append(branch.steps, step)
+			branchOf[step.alias] = branch
+			continue
+		}
+		_, hinted := analysis.PathHints[step.alias]
+		if step.join == sqlparser.LeftJoinStr && cardinality[step.alias] && !hinted && mainAliases[parentAlias] {
+			if branch := newSplitBranch(step, parentAlias); branch != nil {
+				branches = append(branches, branch)
+				branchOf[step.alias] = branch
+				continue
+			}
+		}
+		for alias := range refs {
+			if alias != step.alias && !mainAliases[alias] {
+				return nil, false
+			}
+		}
+		mainAliases[step.alias] = true
+		mainSteps = append(mainSteps, step)
+	}
+	if len(branches) == 0 {
+		return nil, false
+	}
+
+	// The filter applies to the main query only
+	if sel.Where != nil {
+		refs, ok := referencedAliases(sel.Where.Expr)
+		if !ok || !isSubset(refs, mainAliases) {
+			return nil, false
+		}
+	}
+
+	// Divide the columns and the ordering over the queries
+	plan := &splitPlan{columns: columns, mapping: mapping, original: paths, outer: outerPaths(analysis, mapping, paths), printer: printer}
+	selectExprs, ok := db.expandSelectExprs(sel.SelectExprs, analysis)
+	if !ok || len(selectExprs) != len(columns) {
+		return nil, false
+	}
+	mainExprs := sqlparser.SelectExprs{}
+	for i, selectExpr := range selectExprs {
+		refs, _ := referencedAliases(selectExpr)
+		branch, ok := findBranch(refs, mainAliases, branchOf)
+		if !ok {
+			return nil, false
+		}
+		if branch == nil {
+			mainExprs = append(mainExprs, selectExpr)
+			plan.paths = append(plan.paths, paths[i])
+		} else {
+			branch.exprs = append(branch.exprs, selectExpr)
+			branch.paths = append(branch.paths, paths[i])
+		}
+	}
+	mainOrder := sqlparser.OrderBy{}
+	for _, order := range sel.OrderBy {
+		refs, ok := referencedAliases(order)
+		if !ok {
+			return nil, false
+		}
+		branch, ok := findBranch(refs, mainAliases, branchOf)
+		if !ok {
+			return nil, false
+		}
+		if branch == nil {
+			mainOrder = append(mainOrder, order)
+		} else {
+			branch.orderBy = append(branch.orderBy, order)
+		}
+	}
+
+	// Find where the array of each branch is placed in the result of the main query
+	for i, branch := range branches {
+		if len(branch.exprs) == 0 || !branch.locateArray(plan.paths, plan.outer) {
+			return nil, false
+		}
+		for _, other := range branches {
+			if other != branch && hasPathPrefix(other.paths, branch.container+"."+branch.key+"[]") {
+				return nil, false
+			}
+		}
+		branch.keyColumn = fmt.Sprintf("pathsqlx_key_%d", i)
+		mainExprs = append(mainExprs, &sqlparser.AliasedExpr{Expr: branch.parentKey, As: sqlparser.NewColIdent(branch.keyColumn)})
+		plan.paths = append(plan.paths, branch.container+"."+branch.keyColumn)
+		branch.query = branch.buildQuery()
+	}
+
+	main := *sel
+	main.SelectExprs = mainExprs
+	main.From = sqlparser.TableExprs{buildJoins(mainSteps)}
+	main.OrderBy = mainOrder
+	plan.main = &main
+	plan.branches = branches
+	return plan, true
+}
+
+// expandSelectExprs replaces the stars of a select list by the columns they expand to
+func (db *DB) expandSelectExprs(selectExprs sqlparser.SelectExprs, analysis *QueryAnalysis) (sqlparser.SelectExprs, bool) {
+	expanded := sqlparser.SelectExprs{}
+	for _, selectExpr := range selectExprs {
+		star, ok := selectExpr.(*sqlparser.StarExpr)
+		if !ok {
+			expanded = append(expanded, selectExpr)
+			continue
+		}
+		columns, ok := analysis.expandStar(star.TableName.Name.String(), db.metadataReader)
+		if !ok {
+			return nil, false
+		}
+		for _, column := range columns {
+			expanded = append(expanded, &sqlparser.AliasedExpr{Expr: &sqlparser.ColName{
+				Name:      sqlparser.NewColIdent(column.Column),
+				Qualifier: sqlparser.TableName{Name: sqlparser.NewTableIdent(column.Alias)},
+			}})
+		}
+	}
+	return expanded, true
+}
+
+// newSplitBranch creates a branch for a LEFT JOIN that is joined on a single parent column
+func newSplitBranch(step joinStep, parentAlias string) *splitBranch {
+	branch := &splitBranch{
+		rootAlias: step.alias,
+		aliases:   map[string]bool{step.alias: true},
+		steps:     []joinStep{step},
+	}
+	for _, condition := range splitConjunction(step.on) {
+		comparison, ok := condition.(*sqlparser.ComparisonExpr)
+		if ok && comparison.Operator == sqlparser.EqualStr && branch.parentKey == nil {
+			left, leftOk := comparison.Left.(*sqlparser.ColName)
+			right, rightOk := comparison.Right.(*sqlparser.ColName)
+			if leftOk && rightOk {
+				if left.Qualifier.Name.String() == parentAlias && right.Qualifier.Name.String() == step.alias {
+					branch.parentKey, branch.childKey = left, right
+					continue
+				}
+				if right.Qualifier.Name.String() == parentAlias && left.Qualifier.Name.String() == step.alias {
+					branch.parentKey, branch.childKey = right, left
+					continue
+				}
+			}
+		}
+		// Other conditions must only filter the joined table
+		refs, ok := referencedAliases(condition)
+		if !ok || !isSubset(refs, branch.aliases) {
+			return nil
+		}
+		branch.conditions = append(branch.conditions, condition)
+	}
+	if branch.parentKey == nil {
+		return nil
+	}
+	return branch
+}
+
+// locateArray finds the path of the branch array from the paths of its columns, it must not
+// contain any column of the main query
+func (b *splitBranch) locateArray(mainPaths []string, outer map[string]string) bool {
+	path := b.paths[0]
+	prefix := ""
+	for i := strings.Index(path, "[]"); i >= 0; {
+		candidate := path[:i+2]
+		if !hasPathPrefix(mainPaths, candidate) {
+			prefix = candidate
+			break
+		}
+		next := strings.Index(path[i+2:], "[]")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	if prefix == "" || !strings.HasPrefix(prefix, "$") {
+		return false
+	}
+	for _, p := range b.paths {
+		if !strings.HasPrefix(p, prefix+".") {
+			return false
+		}
+	}
+	array := strings.TrimSuffix(prefix, "[]")
+	dot := strings.LastIndex(array, ".")
+	if dot < 0 {
+		return false
+	}
+	b.container = array[:dot]
+	b.key = array[dot+1:]
+	if b.key == "" || strings.ContainsAny(b.key, "[]") {
+		return false
+	}
+
+	// The branch query returns the elements of the array, with the FK of their parent
+	for i, p := range b.paths {
+		b.paths[i] = "$[]" + strings.TrimPrefix(p, prefix)
+	}
+	b.paths = append(b.paths, "$[].pathsqlx_fk")
+	b.outer = make(map[string]string)
+	for p, joinType := range outer {
+		if strings.HasPrefix(p, prefix) {
+			b.outer["$[]"+strings.TrimPrefix(p, prefix)] = joinType
+		}
+	}
+	return true
+}
+
+// buildQuery builds the query for the branch, without the IN list of parent keys
+func (b *splitBranch) buildQuery() *sqlparser.Select {
+	exprs := append(sqlparser.SelectExprs{}, b.exprs...)
+	exprs = append(exprs, &sqlparser.AliasedExpr{Expr: b.childKey, As: sqlparser.NewColIdent("pathsqlx_fk")})
+	query := &sqlparser.Select{
+		SelectExprs: exprs,
+		From:        sqlparser.TableExprs{buildJoins(b.steps)},
+		OrderBy:     b.orderBy,
+	}
+	for _, condition := range b.conditions {
+		query.AddWhere(condition)
+	}
+	return query
+}
+
+// runSplitQuery executes the main query and the branch queries and stitches the branches
+// into the result of the main query
+func (db *DB) runSplitQuery(plan *splitPlan, arg interface{}, analysis *QueryAnalysis) (interface{}, error) {
+	args, ok := db.namedArgs(arg)
+	if !ok {
+		return nil, fmt.Errorf("unsupported argument type for split queries: %T", arg)
+	}
+
+	rows, err := db.namedQuery(plan.printer.String(plan.main), args)
+	if err != nil {
+		return nil, err
+	}
+	records, err := db.getAllRecords(rows, plan.paths)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.combineRecordsIntoTree(records, plan.paths, plan.outer)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, branch := range plan.branches {
+		steps := pathSteps(branch.container)
+
+		// Collect the distinct parent keys
+		keys := []interface{}{}
+		seen := map[string]bool{}
+		_, err := applyAtPath(result, steps, func(value interface{}) (interface{}, error) {
+			if object, ok := value.(*orderedmap.OrderedMap); ok {
+				key, _ := object.Get(branch.keyColumn)
+				if key != nil && !seen[fmt.Sprint(key)] {
+					seen[fmt.Sprint(key)] = true
+					keys = append(keys, key)
+				}
+			}
+			return value, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		children, err := db.fetchBranch(branch, keys, args, plan.printer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Replace the parent key by the array of children
+		result, err = applyAtPath(result, steps, func(value interface{}) (interface{}, error) {
+			object, ok := value.(*orderedmap.OrderedMap)
+			if !ok {
+				return value, nil
+			}
+			key, _ := object.Get(branch.keyColumn)
+			object.Delete(branch.keyColumn)
+			elements := children[fmt.Sprint(key)]
+			if key == nil || elements == nil {
+				elements = []interface{}{}
+			}
+			object.Set(branch.key, elements)
+			return object, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err = selectPolymorphicParents(result, db.newPathInferenceEngine().polymorphicParents(analysis, plan.mapping, plan.original))
+	if err != nil {
+		return nil, err
+	}
+	return db.applyDirectives(result, analysis, plan.columns, plan.mapping, plan.original)
+}
+
+// fetchBranch runs the query of a branch in batches of parent keys and groups the
+// resulting elements by the key of their parent
+func (db *DB) fetchBranch(branch *splitBranch, keys []interface{}, args map[string]interface{}, printer *queryPrinter) (map[string][]interface{}, error) {
+	children := map[string][]interface{}{}
+	for start := 0; start < len(keys); start += splitBatchSize {
+		end := start + splitBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		list := sqlparser.ValTuple{}
+		for i, key := range keys[start:end] {
+			name := fmt.Sprintf("pathsqlx_in_%d", i)
+			args[name] = key
+			list = append(list, sqlparser.NewValArg([]byte(":"+name)))
+		}
+		query := *branch.query
+		query.Where = copyWhere(branch.query.Where, &sqlparser.ComparisonExpr{Operator: sqlparser.InStr, Left: branch.childKey, Right: list})
+
+		rows, err := db.namedQuery(printer.String(&query), args)
+		if err != nil {
+			return nil, err
+		}
+		records, err := db.getAllRecords(rows, branch.paths)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		result, err := db.combineRecordsIntoTree(records, branch.paths, branch.outer)
+		if err != nil {
+			return nil, err
+		}
+		elements, _ := result.([]interface{})
+		for _, element := range elements {
+			object, ok := element.(*orderedmap.OrderedMap)
+			if !ok {
+				continue
+			}
+			parentKey, _ := object.Get("pathsqlx_fk")
+			object.Delete("pathsqlx_fk")
+			children[fmt.Sprint(parentKey)] = append(children[fmt.Sprint(parentKey)], object)
+		}
+	}
+	return children, nil
+}
+
+// namedArgs copies the argument of a named query into a map, so parameters can be added
+func (db *DB) namedArgs(arg interface{}) (map[string]interface{}, bool) {
+	args := map[string]interface{}{}
+	switch a := arg.(type) {
+	case nil:
+		return args, true
+	case map[string]interface{}:
+		for name, value := range a {
+			args[name] = value
+		}
+		return args, true
+	}
+	v := reflect.Indirect(reflect.ValueOf(arg))
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for name, field := range db.Mapper.FieldMap(v) {
+		if field.CanInterface() {
+			args[name] = field.Interface()
+		}
+	}
+	return args, true
+}
+
+// flattenJoins lists the tables of a left-deep join tree in join order
+func flattenJoins(tableExpr sqlparser.TableExpr) ([]joinStep, bool) {
+	switch table := tableExpr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		return []joinStep{{table: table, alias: tableAlias(table)}}, true
+	case *sqlparser.JoinTableExpr:
+		steps, ok := flattenJoins(table.LeftExpr)
+		right, isTable := table.RightExpr.(*sqlparser.AliasedTableExpr)
+		if !ok || !isTable || table.Condition.On == nil || len(table.Condition.Using) > 0 {
+			return nil, false
+		}
+		return append(steps, joinStep{table: right, alias: tableAlias(right), join: table.Join, on: table.Condition.On}), true
+	}
+	return nil, false
+}
+
+// buildJoins builds a left-deep join tree from its tables
+func buildJoins(steps []joinStep) sqlparser.TableExpr {
+	var tableExpr sqlparser.TableExpr = steps[0].table
+	for _, step := range steps[1:] {
+		tableExpr = &sqlparser.JoinTableExpr{
+			LeftExpr:  tableExpr,
+			Join:      step.join,
+			RightExpr: step.table,
+			Condition: sqlparser.JoinCondition{On: step.on},
+		}
+	}
+	return tableExpr
+}
+
+// tableAlias returns the alias of a table expression, or its table name without alias
+func tableAlias(table *sqlparser.AliasedTableExpr) string {
+	if !table.As.IsEmpty() {
+		return table.As.String()
+	}
+	if name, ok := table.Expr.(sqlparser.TableName); ok {
+		return name.Name.String()
+	}
+	return ""
+}
+
+// splitConjunction splits an expression into the conditions that are combined with AND
+func splitConjunction(expr sqlparser.Expr) []sqlparser.Expr {
+	switch e := expr.(type) {
+	case *sqlparser.AndExpr:
+		return append(splitConjunction(e.Left), splitConjunction(e.Right)...)
+	case *sqlparser.ParenExpr:
+		if and, ok := e.Expr.(*sqlparser.AndExpr); ok {
+			return splitConjunction(and)
+		}
+	}
+	return []sqlparser.Expr{expr}
+}
+
+// referencedAliases collects the table aliases used in an expression, it returns false
+// when the expression can't be attributed to tables (unqualified columns, subqueries)
+func referencedAliases(node sqlparser.SQLNode) (map[string]bool, bool) {
+	aliases := map[string]bool{}
+	ok := true
+	sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		switch n := node.(type) {
+		case *sqlparser.ColName:
+			if n.Qualifier.IsEmpty() {
+				ok = false
+			} else {
+				aliases[n.Qualifier.Name.String()] = true
+			}
+		case *sqlparser.Subquery:
+			ok = false
+			return false, nil
+		}
+		return true, nil
+	}, node)
+	return aliases, ok
+}
+
+// findBranch returns the branch of the referenced aliases (nil for the main query),
+// it returns false when the aliases belong to more than one query
+func findBranch(refs map[string]bool, mainAliases map[string]bool, branchOf map[string]*splitBranch) (*splitBranch, bool) {
+	var branch *splitBranch
+	inMain := false
+	for alias := range refs {
+		if mainAliases[alias] {
+			inMain = true
+			continue
+		}
+		b, ok := branchOf[alias]
+		if !ok || (branch != nil && b != branch) {
+			return nil, false
+		}
+		branch = b
+	}
+	if inMain && branch != nil {
+		return nil, false
+	}
+	return branch, true
+}
+
+// isSubset checks if all aliases are in the set
+func isSubset(aliases map[string]bool, set map[string]bool) bool {
+	for alias := range aliases {
+		if !set[alias] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPathPrefix checks if any of the paths is nested in the prefix
+func hasPathPrefix(paths []string, prefix string) bool {
+	for _, path := range paths {
+		if strings.HasPrefix(path, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
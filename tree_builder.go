@@ -0,0 +1,100 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+// buildTrees nests the rows of a TREE directive alias into recursive hierarchies
+// The rows are found in the array at the path of the id column, every occurrence
+// of that array (e.g. the comments of each post) is turned into its own forest.
+func (db *DB) buildTrees(result interface{}, hint TreeHint, columns []string, columnMapping []string, paths []string) (interface{}, error) {
+	arrayPath := ""
+	for i, col := range columns {
+		if col != hint.IDColumn || i >= len(paths) {
+			continue
+		}
+		if columnMapping[i] == hint.Alias+"."+col || arrayPath == "" {
+			arrayPath = strings.TrimSuffix(paths[i], "."+col)
+		}
+	}
+	if arrayPath == "" {
+		return nil, fmt.Errorf("TREE %s requires the column %s in the result", hint.Alias, hint.IDColumn)
+	}
+	if !strings.HasSuffix(arrayPath, "[]") {
+		return nil, fmt.Errorf("TREE %s requires the rows at %s to be an array", hint.Alias, arrayPath)
+	}
+
+	// Apply to the array itself, not to its elements
+	steps := pathSteps(arrayPath)
+	return applyAtPath(result, steps[:len(steps)-1], func(value interface{}) (interface{}, error) {
+		nodes, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+		return buildTree(nodes, hint)
+	})
+}
+
+// buildTree nests nodes under their parents in a single pass over an adjacency list
+// Nodes without a parent in the list are roots, nodes that can't reach a root form a cycle.
+func buildTree(nodes []interface{}, hint TreeHint) ([]interface{}, error) {
+	byID := make(map[string]*orderedmap.OrderedMap)
+	children := make(map[string][]interface{})
+	ids := []string{}
+
+	for _, node := range nodes {
+		object, ok := node.(*orderedmap.OrderedMap)
+		if !ok {
+			return nil, fmt.Errorf("TREE %s requires objects, found %T", hint.Alias, node)
+		}
+		idValue, _ := object.Get(hint.IDColumn)
+		if idValue == nil {
+			return nil, fmt.Errorf("TREE %s requires a non-NULL %s", hint.Alias, hint.IDColumn)
+		}
+		id := fmt.Sprint(idValue)
+		if _, exists := byID[id]; exists {
+			return nil, fmt.Errorf("TREE %s has duplicate %s %s", hint.Alias, hint.IDColumn, id)
+		}
+		byID[id] = object
+		ids = append(ids, id)
+	}
+
+	roots := []interface{}{}
+	for _, id := range ids {
+		object := byID[id]
+		parentValue, _ := object.Get(hint.ParentColumn)
+		parentID := fmt.Sprint(parentValue)
+		if _, exists := byID[parentID]; parentValue == nil || !exists {
+			roots = append(roots, object)
+			continue
+		}
+		children[parentID] = append(children[parentID], object)
+	}
+
+	// Attach the children to every node reachable from the roots
+	attached := make(map[string]bool)
+	queue := append([]interface{}{}, roots...)
+	for len(queue) > 0 {
+		object := queue[0].(*orderedmap.OrderedMap)
+		queue = queue[1:]
+		idValue, _ := object.Get(hint.IDColumn)
+		id := fmt.Sprint(idValue)
+		attached[id] = true
+		nested := children[id]
+		if nested == nil {
+			nested = []interface{}{}
+		}
+		object.Set(hint.ChildrenKey, nested)
+		queue = append(queue, nested...)
+	}
+	for _, id := range ids {
+		if !attached[id] {
+			return nil, fmt.Errorf("TREE %s has a cycle at %s %s", hint.Alias, hint.IDColumn, id)
+		}
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,274 @@
+package pathsqlx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xwb1989/sqlparser"
+)
+
+// unionBranchColumn is the column that is added to every branch of a UNION query to
+// tell which branch a row is from
+const unionBranchColumn = "pathsqlx_branch"
+
+// extractUnionBranches analyzes the branches of a UNION separately, so that a PATH hint
+// in a branch applies to the rows of that branch, and returns the first branch that
+// determines the columns of the result (or the query when it isn't a UNION)
+func extractUnionBranches(sql string, analysis *QueryAnalysis) string {
+	branches := splitUnion(sql)
+	if len(branches) < 2 {
+		return sql
+	}
+	for _, branch := range branches {
+		// The branch is normalized already, normalizing it again doesn't change it
+		branchAnalysis, err := AnalyzeQueryDialect(branch, analysis.Dialect)
+		if err != nil {
+			continue
+		}
+		for name, derived := range analysis.Derived {
+			branchAnalysis.Derived[name] = derived
+		}
+		analysis.Branches = append(analysis.Branches, branchAnalysis)
+	}
+	return branches[0]
+}
+
+// splitUnion splits a query on the UNION keywords outside of parentheses, string literals
+// and comments. Comments before a UNION stay with the branch before it, parentheses
+// around a branch are removed.
+func splitUnion(sql string) []string {
+	union := regexp.MustCompile(`(?i)^UNION(?:\s+(?:ALL|DISTINCT))?\b`)
+	branches := []string{}
+	start := 0
+	depth := 0
+	for i := 0; i < len(sql); i++ {
+		switch ch := sql[i]; {
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == '\'' || ch == '"' || ch == '`':
+			for i++; i < len(sql) && sql[i] != ch; i++ {
+				if sql[i] == '\\' {
+					i++
+				}
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 3
+			}
+		case depth == 0 && (i == 0 || !isWordChar(sql[i-1])):
+			if match := union.FindString(sql[i:]); match != "" {
+				branches = append(branches, unwrapBranch(sql[start:i]))
+				i += len(match) - 1
+				start = i + 1
+			}
+		}
+	}
+	return append(branches, unwrapBranch(sql[start:]))
+}
+
+// unwrapBranch removes the parentheses around a branch of a UNION
+func unwrapBranch(branch string) string {
+	trimmed := skipSpaceAndComments(branch)
+	if !strings.HasPrefix(trimmed, "(") {
+		return branch
+	}
+	end := matchParenthesis(trimmed, 0)
+	if end < 0 || skipSpaceAndComments(trimmed[end+1:]) != "" {
+		return branch
+	}
+	return trimmed[1:end] + "\n" + trimmed[end+1:]
+}
+
+// isWordChar checks whether a character can be part of an identifier
+func isWordChar(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// addUnionBranchColumn adds the branch number as the last column of every branch of a
+// UNION query, returns an error when the query can't be rewritten (the rows of the
+// branches can't be told apart then)
+func addUnionBranchColumn(query string, branches int, dialect Dialect) (string, error) {
+	stmt, printer, err := parseQuery(query, dialect)
+	if err != nil {
+		return "", fmt.Errorf("union branches with different paths can't be told apart: %v", err)
+	}
+	union, ok := stmt.(*sqlparser.Union)
+	if !ok {
+		return "", fmt.Errorf("union branches with different paths can't be told apart: the query is not a UNION")
+	}
+	selects := unionSelects(union)
+	if len(selects) != branches {
+		return "", fmt.Errorf("union branches with different paths can't be told apart: found %d of %d branches", len(selects), branches)
+	}
+	for i, sel := range selects {
+		sel.SelectExprs = append(sel.SelectExprs, &sqlparser.AliasedExpr{
+			Expr: sqlparser.NewIntVal([]byte(strconv.Itoa(i))),
+			As:   sqlparser.NewColIdent(unionBranchColumn),
+		})
+	}
+	return printer.String(union), nil
+}
+
+// unionSelects returns the SELECTs of a UNION from left to right
+func unionSelects(stmt sqlparser.SelectStatement) []*sqlparser.Select {
+	switch stmt := stmt.(type) {
+	case *sqlparser.Union:
+		return append(unionSelects(stmt.Left), unionSelects(stmt.Right)...)
+	case *sqlparser.ParenSelect:
+		return unionSelects(stmt.Select)
+	case *sqlparser.Select:
+		return []*sqlparser.Select{stmt}
+	}
+	return nil
+}
+
+// hasBranchPaths checks whether the branches of a UNION place their rows at different
+// paths, only then the branch column is needed (it prevents UNION from removing duplicates)
+func (db *DB) hasBranchPaths(analysis *QueryAnalysis) bool {
+	columns := []string{}
+	for _, column := range analysis.Branches[0].Columns {
+		if column.Star {
+			return true
+		}
+		name := column.Name
+		if name == "" {
+			name = column.Expr
+		}
+		columns = append(columns, name)
+	}
+	_, first, err := db.columnPaths(analysis.Branches[0], columns)
+	if err != nil {
+		return true
+	}
+	for _, branch := range analysis.Branches[1:] {
+		_, paths, err := db.columnPaths(branch, columns)
+		if err != nil || strings.Join(paths, ",") != strings.Join(first, ",") {
+			return true
+		}
+	}
+	return false
+}
+
+// runUnionQuery runs a UNION query with the branch column, the rows of each branch are
+// placed at the paths of that branch, with the column names of the first branch
+func (db *DB) runUnionQuery(query string, analysis *QueryAnalysis, arg interface{}) (interface{}, error) {
+	rows, err := db.namedQuery(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	columns = columns[:len(columns)-1]
+
+	branchMappings := [][]string{}
+	branchPaths := [][]string{}
+	allPaths := []string{}
+	outer := make(map[string]string)
+	parents := []polymorphicParent{}
+	engine := db.newPathInferenceEngine()
+	for _, branch := range analysis.Branches {
+		mapping, paths, err := db.columnPaths(branch, columns)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		branchMappings = append(branchMappings, mapping)
+		branchPaths = append(branchPaths, paths)
+		allPaths = append(allPaths, paths...)
+		for path, joinType := range outerPaths(branch, mapping, paths) {
+			outer[path] = joinType
+		}
+		parents = append(parents, engine.polymorphicParents(branch, mapping, paths)...)
+	}
+
+	records, err := db.getRecords(rows, branchPaths)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.combineRecordsIntoTree(records, allPaths, outer)
+	if err != nil {
+		return nil, err
+	}
+	result, err = selectPolymorphicParents(result, parents)
+	if err != nil {
+		return nil, err
+	}
+	for i, directives := range branchDirectives(analysis) {
+		result, err = db.applyDirectives(result, directives, columns, branchMappings[i], branchPaths[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// branchDirectives returns the LIMIT and TREE directives of each branch of a UNION, a
+// directive applies to the branch with its alias. Directives outside of the branches
+// (or on aliases of none of them) apply to the first branch.
+func branchDirectives(analysis *QueryAnalysis) []*QueryAnalysis {
+	directives := make([]*QueryAnalysis, len(analysis.Branches))
+	limits := make(map[string]bool)
+	trees := make(map[string]bool)
+	for i, branch := range analysis.Branches {
+		directives[i] = &QueryAnalysis{LimitHints: make(map[string]LimitHint), TreeHints: make(map[string]TreeHint)}
+		for alias, hint := range branch.LimitHints {
+			if _, ok := branch.Tables[alias]; ok {
+				directives[i].LimitHints[alias] = hint
+				limits[alias] = true
+			}
+		}
+		for alias, hint := range branch.TreeHints {
+			if _, ok := branch.Tables[alias]; ok {
+				directives[i].TreeHints[alias] = hint
+				trees[alias] = true
+			}
+		}
+	}
+	for alias, hint := range analysis.LimitHints {
+		if !limits[alias] {
+			i, resolved := branchOfAlias(analysis, alias)
+			hint.OrderBy = append([]OrderHint{}, hint.OrderBy...)
+			for j := range hint.OrderBy {
+				if hint.OrderBy[j].Alias == hint.Alias {
+					hint.OrderBy[j].Alias = resolved
+				}
+			}
+			hint.Alias = resolved
+			directives[i].LimitHints[resolved] = hint
+		}
+	}
+	for alias, hint := range analysis.TreeHints {
+		if !trees[alias] {
+			i, resolved := branchOfAlias(analysis, alias)
+			hint.Alias = resolved
+			directives[i].TreeHints[resolved] = hint
+		}
+	}
+	return directives
+}
+
+// branchOfAlias returns the first branch of a UNION with an alias (or a table used once)
+// and the alias in that branch, the first branch when none of them has it
+func branchOfAlias(analysis *QueryAnalysis, name string) (int, string) {
+	for i, branch := range analysis.Branches {
+		alias := resolveAlias(name, branch)
+		if _, ok := branch.Tables[alias]; ok {
+			return i, alias
+		}
+	}
+	return 0, name
+}